@@ -0,0 +1,147 @@
+// Package apnx implements writing Amazon page number (APNX) files.
+//
+// Kindle readers display real page numbers for a book if a file with
+// the same name and the ".apnx" extension is placed next to it.  Such
+// a file maps page numbers to byte offsets into the uncompressed text
+// of the book.
+package apnx
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Endian describes the byte-order of integers in APNX files.
+var Endian = binary.BigEndian
+
+// PageMap represents the information stored in an APNX file.
+//
+// ASIN and CDEType must match the values stored in the associated
+// book, while ACR is usually the name of its Palm database.
+type PageMap struct {
+	GUID    string
+	ASIN    string
+	CDEType string
+	ACR     string
+	Pages   []int
+}
+
+type contentHeader struct {
+	ContentGUID    string `json:"contentGuid"`
+	ASIN           string `json:"asin"`
+	CDEType        string `json:"cdeType"`
+	Format         string `json:"format"`
+	FileRevisionID string `json:"fileRevisionId"`
+	ACR            string `json:"acr"`
+}
+
+type pageHeader struct {
+	ASIN    string `json:"asin"`
+	PageMap string `json:"pageMap"`
+}
+
+// Write writes out the binary representation of the page map to w.
+func (p PageMap) Write(w io.Writer) error {
+	content, err := json.Marshal(contentHeader{
+		ContentGUID:    p.GUID,
+		ASIN:           p.ASIN,
+		CDEType:        p.CDEType,
+		Format:         "MOBI_8",
+		FileRevisionID: "1",
+		ACR:            p.ACR,
+	})
+	if err != nil {
+		return err
+	}
+	page, err := json.Marshal(pageHeader{
+		ASIN:    p.ASIN,
+		PageMap: "(1,a,1)",
+	})
+	if err != nil {
+		return err
+	}
+
+	offsets := make([]uint32, 0)
+	for _, offset := range p.Pages {
+		offsets = append(offsets, uint32(offset))
+	}
+
+	return writeSequential(w,
+		uint32(0x00010001),      // Version
+		uint32(12+len(content)), // Page header offset
+		uint32(len(content)),    // Content header length
+		content,                 // Content header
+		uint16(1),               // Unknown
+		uint16(len(page)),       // Page header length
+		uint16(len(p.Pages)),    // Page count
+		uint16(32),              // Offset size in bits
+		page,                    // Page header
+		offsets,                 // Page offsets
+	)
+}
+
+// PagesFromMarkers returns the start offsets of the pages in text,
+// where every occurrence of marker starts a new page.
+//
+// The first page always starts at the beginning of text.
+func PagesFromMarkers(text string, marker string) []int {
+	pages := []int{0}
+	if len(marker) == 0 {
+		return pages
+	}
+
+	offset := 0
+	for {
+		i := strings.Index(text[offset:], marker)
+		if i < 0 {
+			break
+		}
+		if offset+i > 0 {
+			pages = append(pages, offset+i)
+		}
+		offset += i + len(marker)
+	}
+
+	return pages
+}
+
+// PagesFromLength returns the start offsets of the pages in text,
+// assuming every page contains the given number of characters.
+//
+// Markup is not counted towards the length of a page.
+func PagesFromLength(text string, charsPerPage int) []int {
+	pages := []int{0}
+	if charsPerPage <= 0 {
+		return pages
+	}
+
+	count := 0
+	inTag := false
+	for i, c := range text {
+		switch {
+		case c == '<':
+			inTag = true
+		case c == '>':
+			inTag = false
+		case !inTag && count == charsPerPage:
+			pages = append(pages, i)
+			count = 1
+		case !inTag:
+			count++
+		}
+	}
+
+	return pages
+}
+
+func writeSequential(w io.Writer, vs ...interface{}) error {
+	for _, v := range vs {
+		err := binary.Write(w, Endian, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
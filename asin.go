@@ -0,0 +1,93 @@
+package mobi
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Content types understood by Kindle readers, for use as the DocType
+// of a Book.
+const (
+	DocTypeEBOK = "EBOK" // Books
+	DocTypePDOC = "PDOC" // Personal documents
+	DocTypeNWPR = "NWPR" // Newspapers
+	DocTypeMAGZ = "MAGZ" // Magazines
+)
+
+// ErrInvalidISBN is returned when an ISBN cannot be converted to an
+// ASIN.
+var ErrInvalidISBN = errors.New("mobi: invalid ISBN")
+
+// ASINFromISBN returns the ASIN corresponding to the given ISBN.
+//
+// The ASIN of a printed book is its ISBN-10, so ISBN-13 identifiers
+// are converted to their ISBN-10 equivalent.  This is not possible
+// for ISBN-13 identifiers with the 979 prefix, for which an error is
+// returned.
+func ASINFromISBN(isbn string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(isbn))
+
+	switch {
+	case len(digits) == 10 && isbnChecksum10(digits[:9]) == digits[9]:
+		return digits, nil
+	case len(digits) == 13 && strings.HasPrefix(digits, "978") && isbnChecksum13(digits[:12]) == digits[12]:
+		return digits[3:12] + string(isbnChecksum10(digits[3:12])), nil
+	default:
+		return "", ErrInvalidISBN
+	}
+}
+
+// ASINFromUUID returns a fake ASIN deterministically derived from the
+// given UUID or any other unique identification string.
+//
+// Like the ASIN generated from the UniqueID of a Book, the result is
+// longer than a real ASIN and will thus never conflict with the ASIN
+// of a book sold by Amazon.
+func ASINFromUUID(uuid string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(uuid)))
+	return fmt.Sprintf("%x", sum)[:15]
+}
+
+func isbnChecksum10(digits string) byte {
+	sum := 0
+	for i, c := range digits {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		sum += (10 - i) * int(c-'0')
+	}
+
+	switch check := (11 - sum%11) % 11; check {
+	case 10:
+		return 'X'
+	default:
+		return byte('0' + check)
+	}
+}
+
+func isbnChecksum13(digits string) byte {
+	sum := 0
+	for i, c := range digits {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		sum += (1 + 2*(i%2)) * int(c-'0')
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+func (m Book) asin() string {
+	if len(m.ASIN) > 0 {
+		return m.ASIN
+	}
+
+	return encodeASIN(m.UniqueID)
+}
@@ -0,0 +1,141 @@
+package edit
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+
+	"github.com/leotaku/mobi"
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+	t "github.com/leotaku/mobi/types"
+)
+
+// ErrCannotAddCover is returned when a cover is added to a book that
+// is not a plain KF8 book.
+var ErrCannotAddCover = errors.New("edit: covers can only be added to KF8 books")
+
+// SetCover replaces the cover image of the book using an image record
+// generated from img according to profile.
+//
+// If the book has no cover image, a new image record is inserted
+// after the existing resources of the book and all header fields that
+// refer to later records are updated.  A separate thumbnail image is
+// replaced using mobi.ThumbnailProfile.
+func (e *Editor) SetCover(img image.Image, profile mobi.ImageProfile) error {
+	cover, err := profile.Record(img)
+	if err != nil {
+		return err
+	}
+
+	null := &e.nulls[0]
+	offset, ok := null.record.EXTHSection.Int(t.EXTHCoverOffset)
+	first := null.record.MOBIHeader.FirstImageIndex
+	if ok && first != math.MaxUint32 && int(first)+offset < len(e.db.Records) {
+		e.db.ReplaceRecord(int(first)+offset, cover)
+	} else {
+		offset, err = e.insertCover(cover)
+		if err != nil {
+			return err
+		}
+	}
+
+	if thumb, ok := null.record.EXTHSection.Int(t.EXTHThumbOffset); ok && thumb != offset {
+		rec, err := mobi.ThumbnailProfile.Record(img)
+		if err != nil {
+			return err
+		}
+		if i := int(null.record.MOBIHeader.FirstImageIndex) + thumb; i < len(e.db.Records) {
+			e.db.ReplaceRecord(i, rec)
+		}
+	} else {
+		e.SetInt(t.EXTHThumbOffset, offset)
+	}
+	e.SetInt(t.EXTHCoverOffset, offset)
+	e.SetInt(t.EXTHHasFakeCover, 0)
+	if null.record.MOBIHeader.FileVersion >= 8 {
+		e.SetStrings(t.EXTHKF8CoverURI, "kindle:embed:"+r.To32(offset+1))
+	}
+
+	return nil
+}
+
+// insertCover inserts the cover record after all resources of the
+// book and returns its offset relative to the first image record.
+func (e *Editor) insertCover(cover pdb.Record) (int, error) {
+	h := &e.nulls[0].record.MOBIHeader
+	if len(e.nulls) > 1 || h.FileVersion < 8 {
+		return 0, ErrCannotAddCover
+	}
+
+	count, ok := e.nulls[0].record.EXTHSection.Int(t.EXTHKF8CountResources)
+	if h.FirstImageIndex == math.MaxUint32 {
+		// Resources precede the FDST record
+		h.FirstImageIndex = uint32(h.FirstContentRecordNumberOrFDSTNumberMSB)<<16 |
+			uint32(h.LastContentRecordNumberOrFDSTNumberLSB)
+		if h.FirstImageIndex == math.MaxUint32 {
+			h.FirstImageIndex = uint32(len(e.db.Records) - 1)
+		}
+		count = 0
+	} else if !ok {
+		count = e.countResources(int(h.FirstImageIndex))
+	}
+
+	i := int(h.FirstImageIndex) + count
+	if i > len(e.db.Records) {
+		return 0, ErrNotMOBI
+	}
+	e.db.InsertRecord(i, cover)
+	shiftRecords(h, i)
+	e.SetInt(t.EXTHKF8CountResources, count+1)
+
+	return count, nil
+}
+
+// countResources returns the number of resource records starting at
+// index first, which are followed by the FDST record or other records
+// that are not resources.
+func (e *Editor) countResources(first int) int {
+	count := 0
+	for i := first; i < len(e.db.Records); i++ {
+		buf := bytes.NewBuffer(nil)
+		err := e.db.Records[i].Write(buf)
+		if err != nil {
+			break
+		}
+		for _, magic := range []string{"FDST", "FLIS", "FCIS", "SRCS", "BOUN", "\xe9\x8e\r\n"} {
+			if bytes.HasPrefix(buf.Bytes(), []byte(magic)) {
+				return count
+			}
+		}
+		count++
+	}
+
+	return count
+}
+
+// shiftRecords updates all fields of the header that refer to records
+// at or after index i after a record has been inserted at i.
+func shiftRecords(h *t.KF8Header, i int) {
+	fields := []*uint32{
+		&h.FirstNonBookIndex, &h.OrthographicIndex, &h.InflectionIndex,
+		&h.IndexNames, &h.IndexKeys, &h.ExtraIndex0, &h.ExtraIndex1,
+		&h.ExtraIndex2, &h.ExtraIndex3, &h.ExtraIndex4, &h.ExtraIndex5,
+		&h.HuffmanRecordOffset, &h.FCISRecordNumber, &h.FLISRecordNumber,
+		&h.Unknown5, &h.INDXRecordOffset, &h.ChunkIndex,
+		&h.SkeletonIndex, &h.HuffmanTableIndex, &h.GuideIndex,
+	}
+	for _, f := range fields {
+		if *f != math.MaxUint32 && *f != 0 && int(*f) >= i {
+			*f++
+		}
+	}
+
+	fdst := uint32(h.FirstContentRecordNumberOrFDSTNumberMSB)<<16 | uint32(h.LastContentRecordNumberOrFDSTNumberLSB)
+	if fdst != math.MaxUint32 && int(fdst) >= i {
+		fdst++
+		h.FirstContentRecordNumberOrFDSTNumberMSB = uint16(fdst >> 16)
+		h.LastContentRecordNumberOrFDSTNumberLSB = uint16(fdst)
+	}
+}
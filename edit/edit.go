@@ -0,0 +1,163 @@
+// Package edit implements editing the metadata of existing MOBI and
+// AZW3 books without regenerating them.
+//
+// Only the null records of a book are rewritten, while all other
+// records are preserved byte-for-byte.  Combined MOBI and KF8 files
+// contain two null records, which are edited in the same way.
+package edit
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/leotaku/mobi"
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+	t "github.com/leotaku/mobi/types"
+	"golang.org/x/text/language"
+)
+
+// ErrNotMOBI is returned when a database does not contain a MOBI
+// book.
+var ErrNotMOBI = errors.New("edit: not a MOBI book")
+
+// Editor edits the metadata of a book stored in a PalmDB database.
+//
+// Changes are only applied to the database returned by Database, so
+// the original database is never modified.
+type Editor struct {
+	db    pdb.Database
+	nulls []nullRecord
+}
+
+// nullRecord is a parsed null record together with its position and
+// original data.
+type nullRecord struct {
+	index  int
+	data   []byte
+	record r.NullRecord
+}
+
+// Open parses the null records of the book stored in db.
+func Open(db pdb.Database) (*Editor, error) {
+	e := &Editor{db: db}
+	e.db.Records = append([]pdb.Record(nil), db.Records...)
+	err := e.readNullRecord(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Combined MOBI and KF8 files store a second null record
+	if boundary, ok := e.nulls[0].record.EXTHSection.Int(t.EXTHKF8Boundary); ok && boundary > 0 && boundary < len(db.Records) {
+		err := e.readNullRecord(boundary)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func (e *Editor) readNullRecord(i int) error {
+	if i >= len(e.db.Records) {
+		return ErrNotMOBI
+	}
+	buf := bytes.NewBuffer(nil)
+	err := e.db.Records[i].Write(buf)
+	if err != nil {
+		return err
+	}
+	null, err := r.ReadNullRecord(buf.Bytes())
+	if err != nil {
+		return ErrNotMOBI
+	}
+	if null.MOBIHeader.HeaderLength < t.MOBIHeaderLength {
+		return ErrNotMOBI
+	}
+	e.nulls = append(e.nulls, nullRecord{
+		index:  i,
+		data:   buf.Bytes(),
+		record: null,
+	})
+
+	return nil
+}
+
+// Title returns the full name of the book.
+func (e *Editor) Title() string {
+	return e.nulls[0].record.FullName
+}
+
+// SetTitle changes the full name of the book and its EXTH title
+// entries.  The name of the PalmDB database is left unchanged, as
+// page maps of the book refer to it.
+func (e *Editor) SetTitle(title string) {
+	for i := range e.nulls {
+		e.nulls[i].record.FullName = title
+	}
+	e.SetStrings(t.EXTHTitle, title)
+	e.SetStrings(t.EXTHUpdatedTitle, title)
+}
+
+// SetLanguage changes the EXTH language entry of the book and the
+// locale stored in its MOBI header.
+func (e *Editor) SetLanguage(lang language.Tag) {
+	e.SetStrings(t.EXTHLanguage, lang.String())
+	for i := range e.nulls {
+		e.nulls[i].record.MOBIHeader.Locale = mobi.Locale(lang)
+	}
+}
+
+// Strings returns the data of all EXTH entries with type tp as
+// strings.
+func (e *Editor) Strings(tp t.EXTHEntryType) []string {
+	return e.nulls[0].record.EXTHSection.Strings(tp)
+}
+
+// Int returns the data of the first EXTH entry with type tp as an
+// integer.  Returns false if there is no such entry.
+func (e *Editor) Int(tp t.EXTHEntryType) (int, bool) {
+	return e.nulls[0].record.EXTHSection.Int(tp)
+}
+
+// SetStrings replaces all EXTH entries with type tp by entries with
+// the given values, such as the authors or ASIN of the book.
+func (e *Editor) SetStrings(tp t.EXTHEntryType, values ...string) {
+	for i := range e.nulls {
+		e.nulls[i].record.EXTHSection.Remove(tp)
+		e.nulls[i].record.EXTHSection.AddString(tp, values...)
+	}
+}
+
+// SetInt replaces all EXTH entries with type tp by entries with the
+// given integer values, such as the cover offset of the book.
+func (e *Editor) SetInt(tp t.EXTHEntryType, values ...int) {
+	for i := range e.nulls {
+		e.nulls[i].record.EXTHSection.Remove(tp)
+		e.nulls[i].record.EXTHSection.AddInt(tp, values...)
+	}
+}
+
+// Remove removes all EXTH entries with type tp.
+func (e *Editor) Remove(tp t.EXTHEntryType) {
+	for i := range e.nulls {
+		e.nulls[i].record.EXTHSection.Remove(tp)
+	}
+}
+
+// Database returns a copy of the original database in which the null
+// records and the records of replaced or added images have been
+// changed.
+func (e *Editor) Database() (pdb.Database, error) {
+	db := e.db
+	db.Records = append([]pdb.Record(nil), e.db.Records...)
+	for _, null := range e.nulls {
+		data, err := r.RewriteNullRecord(null.data, null.record)
+		if err != nil {
+			return db, err
+		}
+		db.ReplaceRecord(null.index, pdb.RawRecord(data))
+	}
+
+	return db, nil
+}
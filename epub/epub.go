@@ -0,0 +1,490 @@
+// Package epub implements exporting KF8 books to EPUB 3.
+//
+// HTML files are reassembled from the skeleton and chunk indices of a
+// book, while secondary flows such as stylesheets and all images are
+// stored as separate files.  Links using "kindle:embed", "kindle:flow"
+// and "kindle:pos" URIs are rewritten to relative paths, and the
+// navigation document is generated from the NCX index.
+package epub
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+	t "github.com/leotaku/mobi/types"
+)
+
+var (
+	// ErrNotKF8 is returned when a database does not contain a KF8 book.
+	ErrNotKF8 = errors.New("epub: not a KF8 book")
+	// ErrUnsupportedCompression is returned when the text of a book is
+	// compressed using a scheme other than PalmDOC compression.
+	ErrUnsupportedCompression = errors.New("epub: unsupported text compression")
+	// ErrInvalidIndex is returned when an index of a book is malformed.
+	ErrInvalidIndex = errors.New("epub: invalid index")
+)
+
+// Export writes the KF8 book stored in db to w as an EPUB 3 file.
+//
+// Fonts and other resources that are not images are not exported.
+func Export(w io.Writer, db pdb.Database) error {
+	b, err := readBook(db)
+	if err != nil {
+		return err
+	}
+
+	return b.export(w)
+}
+
+var (
+	embedRegexp = regexp.MustCompile(`kindle:embed:([0-9A-V]{4})(?:\?mime=[a-z]+/[a-z0-9.+-]+)?`)
+	flowRegexp  = regexp.MustCompile(`kindle:flow:([0-9A-V]{4})(?:\?mime=([a-z]+/[a-z0-9.+-]+))?`)
+	posRegexp   = regexp.MustCompile(`kindle:pos:fid:([0-9A-V]{4}):off:([0-9A-V]{10})`)
+	aidRegexp   = regexp.MustCompile(`\s+aid="[^"]*"`)
+	idRegexp    = regexp.MustCompile(`^<[^>]*\sid="([^"]*)"`)
+)
+
+// mediaTypes maps the extensions of exported files to their media
+// types.  A fixed table is used instead of the mime package so that
+// the output does not depend on the MIME database of the host.
+var mediaTypes = map[string]string{
+	".jpg":   "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".bmp":   "image/bmp",
+	".svg":   "image/svg+xml",
+	".css":   "text/css",
+	".xhtml": "application/xhtml+xml",
+}
+
+// mediaType returns the media type of files with the given extension.
+func mediaType(ext string) string {
+	if m, ok := mediaTypes[ext]; ok {
+		return m
+	}
+
+	return "application/octet-stream"
+}
+
+// item describes a file of the exported EPUB.
+type item struct {
+	id         string
+	href       string
+	mediaType  string
+	properties string
+	content    string
+}
+
+func (b *book) export(w io.Writer) error {
+	files := b.assembleFiles()
+	flowNames := b.flowNames()
+
+	// Rewrite KF8 links to relative paths
+	rewrite := func(s string) string {
+		s = embedRegexp.ReplaceAllStringFunc(s, func(uri string) string {
+			i := parse32(embedRegexp.FindStringSubmatch(uri)[1]) - 1
+			if data, ok := b.resources[i]; ok {
+				return "../" + imageName(i, data)
+			}
+			return uri
+		})
+		s = flowRegexp.ReplaceAllStringFunc(s, func(uri string) string {
+			if name, ok := flowNames[parse32(flowRegexp.FindStringSubmatch(uri)[1])]; ok {
+				return "../" + name
+			}
+			return uri
+		})
+		return posRegexp.ReplaceAllStringFunc(s, func(uri string) string {
+			m := posRegexp.FindStringSubmatch(uri)
+			file, offset, ok := b.posFid(parse32(m[1]), parse32(m[2]))
+			if !ok {
+				return uri
+			}
+			return "../" + target(files, file, offset)
+		})
+	}
+
+	items := make([]item, 0)
+	for i, file := range files {
+		file = aidRegexp.ReplaceAllString(rewrite(file), "")
+		it := item{
+			id:        fmt.Sprintf("part%04d", i),
+			href:      partName(i),
+			mediaType: "application/xhtml+xml",
+			content:   file,
+		}
+		if strings.Contains(file, "<svg") {
+			it.properties = "svg"
+		}
+		items = append(items, it)
+	}
+	for i := 1; i < len(b.flows); i++ {
+		name, ok := flowNames[i]
+		if !ok {
+			continue
+		}
+		items = append(items, item{
+			id:        "flow" + r.To32(i),
+			href:      name,
+			mediaType: b.flowMIME(i),
+			content:   rewrite(b.flows[i]),
+		})
+	}
+	cover, hasCover := b.null.EXTHSection.Int(t.EXTHCoverOffset)
+	for i := 0; i <= maxKey(b.resources); i++ {
+		data, ok := b.resources[i]
+		if !ok {
+			continue
+		}
+		it := item{
+			id:        "image" + r.To32(i+1),
+			href:      imageName(i, data),
+			mediaType: mediaType(imageExtension(data)),
+			content:   string(data),
+		}
+		if hasCover && i == cover {
+			it.properties = "cover-image"
+		}
+		items = append(items, it)
+	}
+
+	z := zip.NewWriter(w)
+	mw, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(mw, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []struct{ name, content string }{
+		{"META-INF/container.xml", containerXML},
+		{"OEBPS/content.opf", b.packageDocument(items, len(files))},
+		{"OEBPS/nav.xhtml", b.navDocument(files)},
+	} {
+		err := writeFile(z, f.name, f.content)
+		if err != nil {
+			return err
+		}
+	}
+	for _, it := range items {
+		err := writeFile(z, "OEBPS/"+it.href, it.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+func writeFile(z *zip.Writer, name, content string) error {
+	w, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, content)
+
+	return err
+}
+
+// assembleFiles reconstructs all HTML files by inserting the chunks of
+// each file into its skeleton.
+func (b *book) assembleFiles() []string {
+	files := make([]string, 0)
+	chunkID := 0
+	for i, skel := range b.skels {
+		if skel.start+skel.length > len(b.text) {
+			break
+		}
+		file := b.text[skel.start : skel.start+skel.length]
+		base := skel.start + skel.length
+		for j := 0; j < skel.chunkCount && chunkID < len(b.chunks); j++ {
+			c := &b.chunks[chunkID]
+			c.file = i
+			pos := c.insertPos - skel.start
+			if pos < 0 || pos > len(file) || base+c.length > len(b.text) {
+				break
+			}
+			file = file[:pos] + b.text[base:base+c.length] + file[pos:]
+			base += c.length
+			chunkID++
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// posFid returns the file and offset inside the file of the position
+// described by a chunk ID and the offset relative to the chunk.
+func (b *book) posFid(fid, offset int) (int, int, bool) {
+	if fid < 0 || fid >= len(b.chunks) || b.chunks[fid].file >= len(b.skels) {
+		return 0, 0, false
+	}
+	c := b.chunks[fid]
+
+	return c.file, c.insertPos - b.skels[c.file].start + offset, true
+}
+
+// rawPos returns the file and offset inside the file of the position
+// pos in the text.
+func (b *book) rawPos(pos int) (int, int) {
+	file := 0
+	for i, skel := range b.skels {
+		if skel.start <= pos {
+			file = i
+		}
+	}
+	if file >= len(b.skels) {
+		return 0, 0
+	}
+	skel := b.skels[file]
+	if pos < skel.start+skel.length {
+		return file, pos - skel.start
+	}
+
+	// Positions after the skeleton refer to one of its chunks
+	base := skel.start + skel.length
+	for _, c := range b.chunks {
+		if c.file == file {
+			if pos < base+c.length {
+				return file, c.insertPos - skel.start + pos - base
+			}
+			base += c.length
+		}
+	}
+
+	return file, 0
+}
+
+// target returns the path of the given file, including a fragment if
+// the element at offset has an ID.
+func target(files []string, file, offset int) string {
+	name := partName(file)
+	if file >= len(files) || offset <= 0 || offset >= len(files[file]) {
+		return name
+	}
+
+	start := strings.LastIndexByte(files[file][:offset+1], '<')
+	if start < 0 {
+		return name
+	}
+	m := idRegexp.FindStringSubmatch(files[file][start:])
+	if m == nil {
+		return name
+	}
+
+	return name + "#" + m[1]
+}
+
+// flowNames returns the paths of all secondary flows.
+func (b *book) flowNames() map[int]string {
+	names := make(map[int]string)
+	for i := 1; i < len(b.flows); i++ {
+		mimeType := b.flowMIME(i)
+		ext := ".bin"
+		for e, m := range mediaTypes {
+			if m == mimeType {
+				ext = e
+			}
+		}
+		dir := "images/"
+		if mimeType == "text/css" {
+			dir = "styles/"
+		}
+		names[i] = dir + "flow" + r.To32(i) + ext
+	}
+
+	return names
+}
+
+// flowMIME returns the MIME type of the flow with index i, as declared
+// by references to the flow or guessed from its content.
+func (b *book) flowMIME(i int) string {
+	id := r.To32(i)
+	for _, s := range append([]string{b.text}, b.flows[1:]...) {
+		for _, m := range flowRegexp.FindAllStringSubmatch(s, -1) {
+			if m[1] == id && len(m[2]) > 0 {
+				return m[2]
+			}
+		}
+	}
+
+	trimmed := strings.TrimSpace(b.flows[i])
+	if strings.HasPrefix(trimmed, "<svg") || strings.HasPrefix(trimmed, "<?xml") {
+		return "image/svg+xml"
+	}
+
+	return "text/css"
+}
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+func (b *book) packageDocument(items []item, partCount int) string {
+	exth := b.null.EXTHSection
+	sb := new(strings.Builder)
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	sb.WriteString(`<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">` + "\n")
+	sb.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` + "\n")
+
+	identifier := fmt.Sprintf("urn:mobi:%08x", b.null.MOBIHeader.UniqueID)
+	if asin := exth.Strings(t.EXTHASIN); len(asin) > 0 {
+		identifier = asin[0]
+	}
+	language := "und"
+	if lang := exth.Strings(t.EXTHLanguage); len(lang) > 0 {
+		language = lang[0]
+	}
+	writeElement(sb, `dc:identifier id="uid"`, identifier)
+	writeElement(sb, "dc:title", b.title())
+	writeElement(sb, "dc:language", language)
+	for _, tp := range []struct {
+		name string
+		exth t.EXTHEntryType
+	}{
+		{"dc:creator", t.EXTHAuthor},
+		{"dc:contributor", t.EXTHContributor},
+		{"dc:publisher", t.EXTHPublisher},
+		{"dc:subject", t.EXTHSubject},
+		{"dc:description", t.EXTHDescription},
+		{"dc:rights", t.EXTHRights},
+	} {
+		for _, s := range exth.Strings(tp.exth) {
+			writeElement(sb, tp.name, s)
+		}
+	}
+	if date := exth.Strings(t.EXTHPublishingDate); len(date) > 0 && len(date[0]) >= 10 {
+		writeElement(sb, "dc:date", date[0][:10])
+	}
+	writeElement(sb, `meta property="dcterms:modified"`, b.date)
+	if fixed := exth.Strings(t.EXTHFixedLayout); len(fixed) > 0 && fixed[0] == "true" {
+		writeElement(sb, `meta property="rendition:layout"`, "pre-paginated")
+	}
+	sb.WriteString("  </metadata>\n")
+
+	sb.WriteString("  <manifest>\n")
+	sb.WriteString(`    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` + "\n")
+	for _, it := range items {
+		fmt.Fprintf(sb, `    <item id="%v" href="%v" media-type="%v"`, it.id, it.href, it.mediaType)
+		if len(it.properties) > 0 {
+			fmt.Fprintf(sb, ` properties="%v"`, it.properties)
+		}
+		sb.WriteString("/>\n")
+	}
+	sb.WriteString("  </manifest>\n")
+
+	if dir := exth.Strings(t.EXTHPageProgressionDirection); len(dir) > 0 {
+		fmt.Fprintf(sb, `  <spine page-progression-direction="%v">`+"\n", html.EscapeString(dir[0]))
+	} else {
+		sb.WriteString("  <spine>\n")
+	}
+	for i := 0; i < partCount; i++ {
+		fmt.Fprintf(sb, `    <itemref idref="part%04d"/>`+"\n", i)
+	}
+	sb.WriteString("  </spine>\n")
+	sb.WriteString("</package>\n")
+
+	return sb.String()
+}
+
+func (b *book) navDocument(files []string) string {
+	sb := new(strings.Builder)
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	sb.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` + "\n")
+	fmt.Fprintf(sb, "<head><title>%v</title></head>\n", html.EscapeString(b.title()))
+	sb.WriteString(`<body><nav epub:type="toc" id="toc">`)
+
+	// Entries refer to their parent by index
+	children := make(map[int][]int)
+	for i, entry := range b.ncx {
+		parent := entry.parent
+		if entry.depth == 0 || parent >= len(b.ncx) {
+			parent = -1
+		}
+		children[parent] = append(children[parent], i)
+	}
+
+	var list func(parent int)
+	list = func(parent int) {
+		sb.WriteString("<ol>")
+		for _, i := range children[parent] {
+			entry := b.ncx[i]
+			file, offset := b.rawPos(entry.pos)
+			if entry.fid >= 0 {
+				file, offset, _ = b.posFid(entry.fid, entry.offset)
+			}
+			fmt.Fprintf(sb, `<li><a href="%v">%v</a>`, html.EscapeString(target(files, file, offset)), html.EscapeString(entry.title))
+			if len(children[i]) > 0 {
+				list(i)
+			}
+			sb.WriteString("</li>")
+		}
+		sb.WriteString("</ol>")
+	}
+	if len(children[-1]) > 0 {
+		list(-1)
+	} else {
+		sb.WriteString("<ol>")
+		for i := range files {
+			fmt.Fprintf(sb, `<li><a href="%v">%v %v</a></li>`, partName(i), html.EscapeString(b.title()), i+1)
+		}
+		sb.WriteString("</ol>")
+	}
+	sb.WriteString("</nav></body>\n</html>\n")
+
+	return sb.String()
+}
+
+func (b *book) title() string {
+	if len(b.null.FullName) > 0 {
+		return b.null.FullName
+	}
+	if title := b.null.EXTHSection.Strings(t.EXTHTitle); len(title) > 0 {
+		return title[0]
+	}
+
+	return "Untitled"
+}
+
+func writeElement(sb *strings.Builder, tag, content string) {
+	name := strings.Fields(tag)[0]
+	fmt.Fprintf(sb, "    <%v>%v</%v>\n", tag, html.EscapeString(content), name)
+}
+
+func partName(i int) string {
+	return fmt.Sprintf("text/part%04d.xhtml", i)
+}
+
+func imageName(i int, data []byte) string {
+	return "images/image" + r.To32(i+1) + imageExtension(data)
+}
+
+func parse32(s string) int {
+	i, _ := strconv.ParseInt(s, 32, 64)
+	return int(i)
+}
+
+func maxKey(m map[int][]byte) int {
+	result := -1
+	for k := range m {
+		if k > result {
+			result = k
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,299 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/leotaku/mobi/palmdoc"
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+	t "github.com/leotaku/mobi/types"
+)
+
+// book is the content of a KF8 database.
+type book struct {
+	null      r.NullRecord
+	date      string
+	text      string
+	flows     []string
+	skels     []skeleton
+	chunks    []chunk
+	ncx       []ncxEntry
+	resources map[int][]byte
+}
+
+type skeleton struct {
+	start      int
+	length     int
+	chunkCount int
+}
+
+type chunk struct {
+	insertPos int
+	length    int
+	file      int
+}
+
+// ncxEntry is an entry of the NCX index.  Entries either refer to a
+// position in the text or, if fid is not negative, to an offset
+// relative to a chunk.
+type ncxEntry struct {
+	title  string
+	pos    int
+	fid    int
+	offset int
+	depth  int
+	parent int
+}
+
+func readBook(db pdb.Database) (*book, error) {
+	recs := make([][]byte, 0)
+	for _, rec := range db.Records {
+		buf := bytes.NewBuffer(nil)
+		err := rec.Write(buf)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, buf.Bytes())
+	}
+	if len(recs) == 0 {
+		return nil, ErrNotKF8
+	}
+	null, err := r.ReadNullRecord(recs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Combined MOBI and KF8 files store the KF8 part after a boundary
+	if boundary, ok := null.EXTHSection.Int(t.EXTHKF8Boundary); ok && boundary < len(recs) {
+		recs = recs[boundary:]
+		null, err = r.ReadNullRecord(recs[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if null.MOBIHeader.FileVersion < 8 || null.MOBIHeader.HeaderLength < t.KF8HeaderLength {
+		return nil, ErrNotKF8
+	}
+
+	b := &book{
+		null:      null,
+		date:      db.Date.UTC().Format("2006-01-02T15:04:05Z"),
+		resources: make(map[int][]byte),
+	}
+	err = b.readText(recs)
+	if err != nil {
+		return nil, err
+	}
+	b.readFlows(recs)
+	err = b.readIndices(recs)
+	if err != nil {
+		return nil, err
+	}
+	b.readResources(recs)
+
+	return b, nil
+}
+
+func (b *book) readText(recs [][]byte) error {
+	compression := b.null.PalmDocHeader.Compression
+	if compression != 1 && compression != 2 {
+		return ErrUnsupportedCompression
+	}
+
+	text := bytes.NewBuffer(nil)
+	count := int(b.null.PalmDocHeader.TextRecordCount)
+	for i := 1; i <= count && i < len(recs); i++ {
+		data := recs[i]
+		data = data[:len(data)-trailingSize(data, b.null.MOBIHeader.ExtraRecordDataFlags)]
+		if compression == 2 {
+			var err error
+			data, err = palmdoc.Decompress(data)
+			if err != nil {
+				return err
+			}
+		}
+		text.Write(data)
+	}
+	b.text = text.String()
+
+	return nil
+}
+
+// trailingSize returns the size of the trailing entries of a text
+// record, as indicated by the extra data flags.
+func trailingSize(data []byte, flags uint32) int {
+	size := 0
+	for bits := flags >> 1; bits != 0; bits >>= 1 {
+		if bits&1 != 0 && size < len(data) {
+			size += backwardVwi(data[:len(data)-size])
+		}
+	}
+	if flags&1 != 0 && size < len(data) {
+		size += int(data[len(data)-size-1]&0x03) + 1
+	}
+
+	return min(size, len(data))
+}
+
+// backwardVwi decodes the variable-width integer at the end of data.
+func backwardVwi(data []byte) int {
+	value, shift := 0, 0
+	for i := len(data) - 1; i >= 0 && shift < 28; i-- {
+		value |= int(data[i]&0x7F) << shift
+		shift += 7
+		if data[i]&0x80 != 0 {
+			break
+		}
+	}
+
+	return value
+}
+
+func (b *book) readFlows(recs [][]byte) {
+	b.flows = []string{b.text}
+	idx := int(b.null.MOBIHeader.FirstContentRecordNumberOrFDSTNumberMSB)<<16 |
+		int(b.null.MOBIHeader.LastContentRecordNumberOrFDSTNumberLSB)
+	if idx >= len(recs) || !bytes.HasPrefix(recs[idx], []byte("FDST")) {
+		return
+	}
+
+	h := t.FDSTHeader{}
+	data := bytes.NewReader(recs[idx])
+	err := binary.Read(data, pdb.Endian, &h)
+	if err != nil {
+		return
+	}
+	flows := make([]string, 0)
+	for i := 0; i < int(h.EntryCount); i++ {
+		entry := t.FDSTEntry{}
+		err := binary.Read(data, pdb.Endian, &entry)
+		if err != nil || entry.Start > entry.End || int(entry.End) > len(b.text) {
+			return
+		}
+		flows = append(flows, b.text[entry.Start:entry.End])
+	}
+	if len(flows) > 0 {
+		b.flows = flows
+	}
+}
+
+func (b *book) readIndices(recs [][]byte) error {
+	skels, err := readIndex(recs, b.null.MOBIHeader.SkeletonIndex)
+	if err != nil {
+		return err
+	}
+	for _, e := range skels.Entries {
+		geometry := e.Get(t.TAGXTagSkeletonGeometry)
+		count := e.Get(t.TAGXTagSkeletonChunkCount)
+		if len(geometry) < 2 || len(count) < 1 {
+			return ErrInvalidIndex
+		}
+		b.skels = append(b.skels, skeleton{
+			start:      geometry[0],
+			length:     geometry[1],
+			chunkCount: count[0],
+		})
+	}
+
+	chunks, err := readIndex(recs, b.null.MOBIHeader.ChunkIndex)
+	if err != nil {
+		return err
+	}
+	for _, e := range chunks.Entries {
+		pos, err := strconv.Atoi(e.Label)
+		geometry := e.Get(t.TAGXTagChunkGeometry)
+		if err != nil || len(geometry) < 2 {
+			return ErrInvalidIndex
+		}
+		b.chunks = append(b.chunks, chunk{
+			insertPos: pos,
+			length:    geometry[1],
+		})
+	}
+
+	ncx, err := readIndex(recs, b.null.MOBIHeader.INDXRecordOffset)
+	if err != nil {
+		return err
+	}
+	for _, e := range ncx.Entries {
+		entry := ncxEntry{fid: -1, parent: -1}
+		if v := e.Get(t.TAGXTagEntryPosition); len(v) > 0 {
+			entry.pos = v[0]
+		}
+		if v := e.Get(t.TAGXTagEntryNameOffset); len(v) > 0 {
+			entry.title, _ = ncx.String(v[0])
+		}
+		if v := e.Get(t.TAGXTagEntryDepthLevel); len(v) > 0 {
+			entry.depth = v[0]
+		}
+		if v := e.Get(t.TAGXTagEntryParent); len(v) > 0 {
+			entry.parent = v[0]
+		}
+		if v := e.Get(t.TAGXTagEntryPosFid); len(v) > 1 {
+			entry.fid, entry.offset = v[0], v[1]
+		}
+		b.ncx = append(b.ncx, entry)
+	}
+
+	return nil
+}
+
+// readIndex decodes the index with the header record at idx, where
+// missing indices result in an empty index.
+func readIndex(recs [][]byte, idx uint32) (r.Index, error) {
+	if int64(idx) >= int64(len(recs)) {
+		return r.Index{}, nil
+	}
+	index, err := r.ReadIndex(recs, int(idx))
+	if err != nil {
+		return r.Index{}, fmt.Errorf("%w: %v", ErrInvalidIndex, err)
+	}
+
+	return index, nil
+}
+
+func (b *book) readResources(recs [][]byte) {
+	if b.null.MOBIHeader.FirstImageIndex == math.MaxUint32 {
+		return
+	}
+	first := int(b.null.MOBIHeader.FirstImageIndex)
+	for i := first; i < len(recs); i++ {
+		data := recs[i]
+		if len(imageExtension(data)) > 0 {
+			b.resources[i-first] = data
+			continue
+		}
+		for _, magic := range []string{"FDST", "FLIS", "FCIS", "SRCS", "BOUN", "\xe9\x8e\r\n"} {
+			if bytes.HasPrefix(data, []byte(magic)) {
+				return
+			}
+		}
+	}
+}
+
+func imageExtension(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return ".png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return ".gif"
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) > 14:
+		return ".bmp"
+	default:
+		return ""
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
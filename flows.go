@@ -0,0 +1,43 @@
+package mobi
+
+import (
+	"fmt"
+
+	r "github.com/leotaku/mobi/records"
+)
+
+// Flow represents a secondary text flow in a Book, such as a CSS
+// stylesheet or an SVG image.
+//
+// Flows are stored after the main HTML text of a book and referenced
+// using "kindle:flow" URIs, which include the MIME type of the flow.
+type Flow struct {
+	MIME    string
+	Content string
+}
+
+// FlowURI returns the URI that may be used to reference the flow with
+// index i in the Flows of the book from HTML.
+//
+// Panics if index i is out of range.
+func (m Book) FlowURI(i int) string {
+	return flowURI(1+len(m.CSSFlows)+i, m.Flows[i].MIME)
+}
+
+// flows returns all secondary flows of the book, starting with the
+// CSSFlows that have been converted to flows.
+func (m Book) flows() []Flow {
+	flows := make([]Flow, 0)
+	for _, css := range m.CSSFlows {
+		flows = append(flows, Flow{
+			MIME:    "text/css",
+			Content: css,
+		})
+	}
+
+	return append(flows, m.Flows...)
+}
+
+func flowURI(id int, mime string) string {
+	return fmt.Sprintf("kindle:flow:%v?mime=%v", r.To32(id), mime)
+}
@@ -0,0 +1,230 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+
+	"github.com/leotaku/mobi/jfif"
+	r "github.com/leotaku/mobi/records"
+)
+
+// ImageURI returns the URI that may be used to reference the image
+// with index i in the Images of the book from HTML.
+func (m Book) ImageURI(i int) string {
+	return fmt.Sprintf("kindle:embed:%v", r.To32(i+1))
+}
+
+// RawImage is a JPEG image that is embedded into a Book using its
+// original data instead of being re-encoded.
+//
+// Image profiles are not applied to raw images.  Instead, the JFIF
+// header, EXIF metadata and progressive data are handled according to
+// the Options of the image, as described by jfif.Rewrite.  The decoded
+// Image is used wherever pixels are required, for example in order to
+// generate thumbnails.
+type RawImage struct {
+	image.Image
+	Data    []byte
+	Options *jfif.Options
+}
+
+// NewRawImage decodes the JPEG data so that it can be used as a
+// RawImage with the given options.
+func NewRawImage(data []byte, o *jfif.Options) (RawImage, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return RawImage{}, err
+	}
+
+	return RawImage{
+		Image:   img,
+		Data:    data,
+		Options: o,
+	}, nil
+}
+
+// ImageProfile describes how images are processed before they are
+// embedded into a Book.
+//
+// Images larger than MaxWidth or MaxHeight are downscaled while
+// preserving their aspect ratio, and images are converted to
+// grayscale if Grayscale is set.  Afterwards, the JPEG quality is
+// lowered step by step starting at Quality until the encoded image
+// fits into MaxBytes.  Should the image still be too large at
+// MinQuality, it is downscaled further until it fits.
+//
+// Units, XDensity and YDensity are written to the JFIF header of the
+// encoded image.  Covers and thumbnails are processed using the
+// CoverProfile of a Book instead, if it has been set.  Images of type
+// RawImage are never processed.
+//
+// The zero value leaves dimensions and colors untouched, but still
+// ensures that every image fits into the size limit imposed on image
+// records by Kindle readers.
+type ImageProfile struct {
+	MaxWidth   int
+	MaxHeight  int
+	MaxBytes   int
+	Quality    int
+	MinQuality int
+	Grayscale  bool
+	Units      jfif.Units
+	XDensity   uint16
+	YDensity   uint16
+}
+
+// Image profiles for common Kindle readers.
+var (
+	ProfileKindle           = ImageProfile{MaxWidth: 1072, MaxHeight: 1448, Grayscale: true}
+	ProfileKindlePaperwhite = ImageProfile{MaxWidth: 1236, MaxHeight: 1648, Grayscale: true}
+	ProfileKindleOasis      = ImageProfile{MaxWidth: 1264, MaxHeight: 1680, Grayscale: true}
+	ProfileKindleScribe     = ImageProfile{MaxWidth: 1860, MaxHeight: 2480, Grayscale: true}
+	ProfileKindleColorsoft  = ImageProfile{MaxWidth: 1264, MaxHeight: 1680}
+	ProfileKindleFireHD     = ImageProfile{MaxWidth: 1200, MaxHeight: 1920}
+)
+
+const (
+	defaultMinQuality = 20
+	qualityStep       = 10
+)
+
+// Apply resizes and converts the Image img according to the profile.
+//
+// The resulting image is never larger than the original image.
+func (p ImageProfile) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	width, height := fitDimensions(b.Dx(), b.Dy(), p.MaxWidth, p.MaxHeight)
+	if width != b.Dx() || height != b.Dy() {
+		img = resize(img, width, height)
+	}
+	if p.Grayscale {
+		img = toGray(img)
+	}
+
+	return img
+}
+
+// Record processes the Image img according to the profile and
+// converts the result to an image record.
+//
+// Returns an error if the image cannot be encoded as JPEG.
+func (p ImageProfile) Record(img image.Image) (r.ImageRecord, error) {
+	img = p.Apply(img)
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 || maxBytes > r.ImageRecordMaxSize {
+		maxBytes = r.ImageRecordMaxSize
+	}
+	quality := p.Quality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	minQuality := p.MinQuality
+	if minQuality <= 0 || minQuality > quality {
+		minQuality = min(defaultMinQuality, quality)
+	}
+
+	for {
+		size, err := encodedSize(img, p.options(quality))
+		if err != nil {
+			return r.ImageRecord{}, err
+		}
+
+		b := img.Bounds()
+		switch {
+		case size <= maxBytes || b.Dx() <= 1 && b.Dy() <= 1:
+			return r.NewImageRecordWithOptions(img, p.options(quality)), nil
+		case quality > minQuality:
+			quality = max(quality-qualityStep, minQuality)
+		default:
+			width := max(b.Dx()*3/4, 1)
+			height := max(b.Dy()*3/4, 1)
+			img = resize(img, width, height)
+			if p.Grayscale {
+				img = toGray(img)
+			}
+		}
+	}
+}
+
+func (p ImageProfile) options(quality int) *jfif.Options {
+	return &jfif.Options{
+		Quality:  quality,
+		Units:    p.Units,
+		XDensity: p.XDensity,
+		YDensity: p.YDensity,
+	}
+}
+
+func encodedSize(img image.Image, o *jfif.Options) (int, error) {
+	buf := bytes.NewBuffer(nil)
+	err := jfif.EncodeWithOptions(buf, img, o)
+	if err != nil {
+		return 0, err
+	}
+
+	return buf.Len(), nil
+}
+
+func fitDimensions(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = max(height*maxWidth/width, 1)
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = max(width*maxHeight/height, 1)
+		height = maxHeight
+	}
+
+	return width, height
+}
+
+func toGray(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return gray
+}
+
+// resize scales img to the given dimensions by averaging over the
+// area of the source image covered by each destination pixel.
+func resize(img image.Image, width, height int) image.Image {
+	src := image.NewRGBA64(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := max((y+1)*sh/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := max((x+1)*sw/width, x0+1)
+			var cr, cg, cb, ca, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.RGBA64At(src.Rect.Min.X+sx, src.Rect.Min.Y+sy)
+					cr += uint64(c.R)
+					cg += uint64(c.G)
+					cb += uint64(c.B)
+					ca += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(cr / n),
+				G: uint16(cg / n),
+				B: uint16(cb / n),
+				A: uint16(ca / n),
+			})
+		}
+	}
+
+	return dst
+}
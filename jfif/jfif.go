@@ -1,37 +1,71 @@
-// Package jfif implements writing JPEG images with fixed JFIF header.
+// Package jfif implements writing JPEG images with configurable JFIF
+// header.
 package jfif
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/jpeg"
 	"io"
 )
 
-var naiveJFIFHeader = []byte{
-	0xFF, 0xD8, // SOI
-	0xFF, 0xE0, // APP0 Marker
-	0x00, 0x10, // Length
-	0x4A, 0x46, 0x49, 0x46, 0x00, // JFIF\0
-	0x01, 0x02, // 1.02
-	0x00,       // Density type
-	0x00, 0x01, // X Density
-	0x00, 0x01, // Y Density
-	0x00, 0x00, // No Thumbnail
+// Units describes the unit of the pixel density in a JFIF header.
+type Units byte
+
+const (
+	NoUnits     Units = 0 // Density only specifies the aspect ratio
+	DotsPerInch Units = 1
+	DotsPerCM   Units = 2
+)
+
+// Options are the encoding parameters.
+//
+// Quality ranges from 1 to 100 inclusive, higher is better.  A zero
+// XDensity or YDensity is written as one, which combined with NoUnits
+// describes square pixels.
+//
+// StripEXIF and KeepProgressive only apply to raw JPEG input, as
+// images encoded by this package never contain EXIF metadata and are
+// always written in baseline format.
+type Options struct {
+	Quality         int
+	Units           Units
+	XDensity        uint16
+	YDensity        uint16
+	StripEXIF       bool
+	KeepProgressive bool
 }
 
+// ErrInvalidJPEG is returned when raw input is not a valid JPEG.
+var ErrInvalidJPEG = errors.New("jfif: invalid JPEG data")
+
 // Encode writes the Image m to w in JFIF 1.02 compatible format with
-// the given options. The JFIF header cannot be configured.
+// the given options. The JFIF header describes square pixels, use
+// EncodeWithOptions in order to configure it.
 func Encode(w io.Writer, m image.Image, o *jpeg.Options) error {
+	var opts *Options
+	if o != nil {
+		opts = &Options{Quality: o.Quality}
+	}
+
+	return EncodeWithOptions(w, m, opts)
+}
+
+// EncodeWithOptions writes the Image m to w in JFIF 1.02 compatible
+// format with the given options. Default parameters are used if a nil
+// *Options is passed.
+func EncodeWithOptions(w io.Writer, m image.Image, o *Options) error {
 	buf := bytes.NewBuffer(nil)
-	err := jpeg.Encode(buf, m, o)
+	err := jpeg.Encode(buf, m, jpegOptions(o))
 	if err != nil {
 		return err
 	}
 
 	// Connect header and body
 	body := buf.Bytes()[2:]
-	_, err = w.Write(naiveJFIFHeader)
+	_, err = w.Write(header(o))
 	if err != nil {
 		return err
 	}
@@ -42,3 +76,116 @@ func Encode(w io.Writer, m image.Image, o *jpeg.Options) error {
 
 	return nil
 }
+
+// Rewrite writes the already encoded JPEG data to w in JFIF 1.02
+// compatible format with the given options, without re-encoding the
+// image whenever possible.
+//
+// Any existing JFIF header is replaced and EXIF metadata is removed if
+// requested.  Progressive input is re-encoded in baseline format
+// unless KeepProgressive is set, as older Kindle readers are unable to
+// display progressive images.
+func Rewrite(w io.Writer, data []byte, o *Options) error {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != markerSOI {
+		return ErrInvalidJPEG
+	}
+
+	// Collect segments up to the start of scan
+	buf := bytes.NewBuffer(header(o))
+	pos := 2
+	for {
+		marker, length, err := readSegment(data, pos)
+		if err != nil {
+			return err
+		}
+		segment := data[pos : pos+2+length]
+		pos += len(segment)
+
+		switch {
+		case marker == markerSOF2 && (o == nil || !o.KeepProgressive):
+			img, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			return EncodeWithOptions(w, img, o)
+		case marker == markerAPP0 && isJFIF(segment[4:]):
+			continue
+		case marker == markerAPP1 && o != nil && o.StripEXIF:
+			continue
+		}
+
+		buf.Write(segment)
+		if marker == markerSOS {
+			break
+		}
+	}
+
+	// Connect header and entropy-coded data
+	_, err := buf.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data[pos:])
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const (
+	markerSOI  byte = 0xD8
+	markerSOF2 byte = 0xC2
+	markerSOS  byte = 0xDA
+	markerAPP0 byte = 0xE0
+	markerAPP1 byte = 0xE1
+)
+
+func readSegment(data []byte, pos int) (byte, int, error) {
+	if pos+4 > len(data) || data[pos] != 0xFF {
+		return 0, 0, ErrInvalidJPEG
+	}
+	length := int(binary.BigEndian.Uint16(data[pos+2:]))
+	if length < 2 || pos+2+length > len(data) {
+		return 0, 0, ErrInvalidJPEG
+	}
+
+	return data[pos+1], length, nil
+}
+
+func isJFIF(segment []byte) bool {
+	return bytes.HasPrefix(segment, []byte("JFIF\x00"))
+}
+
+func header(o *Options) []byte {
+	units, xDensity, yDensity := NoUnits, uint16(1), uint16(1)
+	if o != nil {
+		units = o.Units
+		if o.XDensity != 0 {
+			xDensity = o.XDensity
+		}
+		if o.YDensity != 0 {
+			yDensity = o.YDensity
+		}
+	}
+
+	return []byte{
+		0xFF, markerSOI, // SOI
+		0xFF, markerAPP0, // APP0 Marker
+		0x00, 0x10, // Length
+		0x4A, 0x46, 0x49, 0x46, 0x00, // JFIF\0
+		0x01, 0x02, // 1.02
+		byte(units),                         // Density type
+		byte(xDensity >> 8), byte(xDensity), // X Density
+		byte(yDensity >> 8), byte(yDensity), // Y Density
+		0x00, 0x00, // No Thumbnail
+	}
+}
+
+func jpegOptions(o *Options) *jpeg.Options {
+	if o == nil || o.Quality == 0 {
+		return nil
+	}
+
+	return &jpeg.Options{Quality: o.Quality}
+}
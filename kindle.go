@@ -0,0 +1,104 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ThumbnailProfile is the image profile used to generate images for
+// the Kindle thumbnails folder.
+var ThumbnailProfile = ImageProfile{MaxWidth: 330, MaxHeight: 470}
+
+// ErrNoCover is returned when a thumbnail is requested for a book
+// without cover or thumbnail image.
+var ErrNoCover = errors.New("mobi: book has no cover image")
+
+// Thumbnail returns the JPEG image that should be copied to the Kindle
+// thumbnails folder under the filename returned by GetThumbFilename.
+//
+// The thumbnail is generated from the ThumbImage of the book or, if
+// that is not set, from the CoverImage.
+func (m Book) Thumbnail() ([]byte, error) {
+	img := m.ThumbImage
+	if img == nil {
+		img = m.CoverImage
+	}
+	if img == nil {
+		return nil, ErrNoCover
+	}
+
+	rec, err := ThumbnailProfile.Record(img)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	err = rec.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriteToKindle writes the book to the documents folder of the Kindle
+// reader mounted at dir, and its thumbnail to the thumbnails folder of
+// the same reader.
+//
+// The book is named after its title.  No thumbnail is written if the
+// book has no cover image.
+func (m Book) WriteToKindle(dir string) error {
+	documents := filepath.Join(dir, "documents")
+	thumbnails := filepath.Join(dir, "system", "thumbnails")
+
+	// Write book
+	err := os.MkdirAll(documents, 0755)
+	if err != nil {
+		return err
+	}
+	db, err := m.TryRealize()
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(nil)
+	err = db.Write(buf)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(documents, m.filename()+".azw3")
+	err = os.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	// Write thumbnail
+	thumb, err := m.Thumbnail()
+	if errors.Is(err, ErrNoCover) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = os.MkdirAll(thumbnails, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(thumbnails, m.GetThumbFilename()), thumb, 0644)
+}
+
+func (m Book) filename() string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, m.Title)
+	name = strings.Trim(name, " .")
+	if len(name) == 0 {
+		return m.asin()
+	}
+
+	return name
+}
@@ -1,13 +1,47 @@
 package mobi
 
-import "golang.org/x/text/language"
+import (
+	"sort"
+
+	"golang.org/x/text/language"
+)
 
 var matcher language.Matcher
 
+// Locale returns the code of the supported locale that best matches
+// the given language, as stored in the Locale field of MOBI headers.
+//
+// Like Windows LCIDs, the code stores the primary language in its low
+// ten bits and the sublanguage, which is derived from the region or
+// script of the language, in the bits above.
+func Locale(lang language.Tag) uint32 {
+	return matchLocale(lang)
+}
+
 func matchLocale(lang language.Tag) uint32 {
 	_, index, _ := matcher.Match(lang)
 	match := SupportedLocales[index]
-	return uint32(localeCodeMap[match])
+	return uint32(localeCodeMap[match]) | uint32(matchSublanguage(lang, match))<<10
+}
+
+// matchSublanguage returns the sublanguage code of lang for the
+// supported locale match, or zero if lang does not explicitly specify
+// a known region or script.
+func matchSublanguage(lang, match language.Tag) uint16 {
+	codes := sublanguageCodeMap[match]
+	if region, conf := lang.Region(); conf == language.Exact {
+		if code, ok := codes[region.String()]; ok {
+			return code
+		}
+	}
+	if script, conf := lang.Script(); conf == language.Exact {
+		if code, ok := codes[script.String()]; ok {
+			return code
+		}
+	}
+	base, _ := lang.Base()
+
+	return codes[base.String()]
 }
 
 var (
@@ -29,6 +63,8 @@ var (
 	assamese    = language.MustParse("as")
 	sanskrit    = language.MustParse("sa")
 	konkani     = language.MustParse("kok")
+	bokmal      = language.MustParse("nb")
+	nynorsk     = language.MustParse("nn")
 )
 
 var localeCodeMap = map[language.Tag]uint16{
@@ -53,6 +89,8 @@ var localeCodeMap = map[language.Tag]uint16{
 	language.Korean:     18,
 	language.Dutch:      19,
 	language.Norwegian:  20,
+	bokmal:              20,
+	nynorsk:             20,
 	language.Polish:     21,
 	language.Portuguese: 22,
 	romansh:             23,
@@ -111,17 +149,67 @@ var localeCodeMap = map[language.Tag]uint16{
 	language.Nepali:     97,
 }
 
+// sublanguageCodeMap maps regions, scripts and language variants to
+// the Windows sublanguage codes of the supported locales.
+var sublanguageCodeMap = map[language.Tag]map[string]uint16{
+	language.Arabic: {
+		"SA": 1, "IQ": 2, "EG": 3, "LY": 4, "DZ": 5, "MA": 6, "TN": 7, "OM": 8,
+		"YE": 9, "SY": 10, "JO": 11, "LB": 12, "KW": 13, "AE": 14, "BH": 15, "QA": 16,
+	},
+	language.Chinese: {
+		"TW": 1, "CN": 2, "HK": 3, "SG": 4, "MO": 5,
+		"Hant": 1, "Hans": 2,
+	},
+	language.German: {"DE": 1, "CH": 2, "AT": 3, "LU": 4, "LI": 5},
+	language.English: {
+		"US": 1, "GB": 2, "AU": 3, "CA": 4, "NZ": 5, "IE": 6, "ZA": 7, "JM": 8,
+		"BZ": 10, "TT": 11, "ZW": 12, "PH": 13, "IN": 16, "MY": 17, "SG": 18,
+	},
+	language.Spanish: {
+		"MX": 2, "ES": 3, "GT": 4, "CR": 5, "PA": 6, "DO": 7, "VE": 8, "CO": 9,
+		"PE": 10, "AR": 11, "EC": 12, "CL": 13, "UY": 14, "PY": 15, "BO": 16,
+		"SV": 17, "HN": 18, "NI": 19, "PR": 20, "US": 21,
+	},
+	language.Finnish:    {"FI": 1},
+	language.French:     {"FR": 1, "BE": 2, "CA": 3, "CH": 4, "LU": 5, "MC": 6},
+	language.Italian:    {"IT": 1, "CH": 2},
+	language.Korean:     {"KR": 1},
+	language.Dutch:      {"NL": 1, "BE": 2},
+	bokmal:              {"nb": 1},
+	nynorsk:             {"nn": 2},
+	language.Portuguese: {"BR": 1, "PT": 2},
+	language.Romanian:   {"RO": 1, "MD": 2},
+	language.Croatian:   {"HR": 1, "BA": 4},
+	language.Serbian:    {"Latn": 2, "Cyrl": 3},
+	language.Swedish:    {"SE": 1, "FI": 2},
+	language.Urdu:       {"PK": 1, "IN": 2},
+	azerbaijani:         {"Latn": 1, "Cyrl": 2},
+	language.Malay:      {"MY": 1, "BN": 2},
+	language.Uzbek:      {"Latn": 1, "Cyrl": 2},
+	language.Bengali:    {"IN": 1, "BD": 2},
+	language.Nepali:     {"NP": 1, "IN": 2},
+}
+
 // SupportedLocales is a list of locales supported by MOBI, intended
 // for use with Go language matching facilities.
 //
-// BUG(leotaku): While the MOBI language format supports regions, this
-// implementation does not and explicitly removes region information
-// from the locale stored in the generated MOBI file.
+// The regions and scripts of these locales are not listed, but are
+// encoded as sublanguages of the locale stored in the generated MOBI
+// file whenever they are known.
 var SupportedLocales []language.Tag
 
 func init() {
 	for key := range localeCodeMap {
 		SupportedLocales = append(SupportedLocales, key)
 	}
+
+	// The first locale is used as fallback, so the order matters
+	sort.Slice(SupportedLocales, func(i, j int) bool {
+		a, b := SupportedLocales[i], SupportedLocales[j]
+		if localeCodeMap[a] != localeCodeMap[b] {
+			return localeCodeMap[a] < localeCodeMap[b]
+		}
+		return a.String() < b.String()
+	})
 	matcher = language.NewMatcher(SupportedLocales)
 }
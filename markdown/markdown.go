@@ -0,0 +1,318 @@
+// Package markdown implements converting Markdown documents to books.
+//
+// Level one headings start a new chapter, while level two headings
+// start a sub-chapter of the current chapter.  All other Markdown
+// elements are converted to KF8 HTML without changing the chapter
+// structure.
+package markdown
+
+import (
+	"fmt"
+	"image"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	// Register decoders for common image formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/leotaku/mobi"
+	"golang.org/x/text/language"
+)
+
+// Stylesheet is the CSS flow added to books that contain code blocks.
+const Stylesheet = `pre {
+  margin: 1em 0;
+  white-space: pre-wrap;
+  font-family: monospace;
+  font-size: 0.85em;
+}
+code {
+  font-family: monospace;
+}`
+
+// Convert converts the Markdown files with the given paths in fsys to
+// a Book, with chapters in the order of the files.
+//
+// Files may start with front matter, which consists of "key: value"
+// lines enclosed by lines of three dashes.  The keys "title",
+// "author", "contributor", "publisher", "subject", "language", "date"
+// and "cover" set the corresponding metadata of the book, where
+// multiple authors or contributors may be listed as "[a, b]" or as
+// indented "- a" lines.  The aliases "authors", "contributors" and
+// "lang" are also accepted, where the longer alias takes precedence if
+// both are given.  Unknown keys are ignored and keys in later files
+// take precedence.
+//
+// Images are loaded relative to the Markdown file that references
+// them, added to the Images of the book and referenced using their
+// "kindle:embed" URIs.  Images with absolute URLs are not loaded.
+//
+// The CreatedDate and UniqueID of the resulting book are based on the
+// current time, which may be changed using Book.Reproducible.
+func Convert(fsys fs.FS, paths ...string) (mobi.Book, error) {
+	now := time.Now()
+	c := converter{
+		fsys:   fsys,
+		images: make(map[string]int),
+		book: mobi.Book{
+			CreatedDate: now,
+			UniqueID:    uint32(now.UnixNano()),
+		},
+	}
+	for _, p := range paths {
+		err := c.convertFile(p)
+		if err != nil {
+			return mobi.Book{}, fmt.Errorf("markdown: %v: %w", p, err)
+		}
+	}
+	if c.code {
+		c.book.CSSFlows = append(c.book.CSSFlows, Stylesheet)
+	}
+
+	return c.book, nil
+}
+
+type converter struct {
+	fsys   fs.FS
+	book   mobi.Book
+	images map[string]int
+	code   bool
+}
+
+// section is a chapter under construction.
+type section struct {
+	title string
+	body  *strings.Builder
+	subs  []*section
+}
+
+func (c *converter) convertFile(name string) error {
+	data, err := fs.ReadFile(c.fsys, name)
+	if err != nil {
+		return err
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	meta, text := splitFrontMatter(text)
+	dir := path.Dir(name)
+	err = c.applyMetadata(meta, dir)
+	if err != nil {
+		return err
+	}
+
+	r := &renderer{
+		image: func(src string) (string, error) {
+			return c.loadImage(dir, src)
+		},
+	}
+	blocks := r.blocks(strings.Split(text, "\n"))
+	if r.err != nil {
+		return r.err
+	}
+	c.code = c.code || r.code
+
+	// Group blocks into chapters and sub-chapters, where level two
+	// headings before the first level one heading start chapters
+	chapters := make([]*section, 0)
+	var current, parent *section
+	for _, b := range blocks {
+		switch {
+		case b.heading == 1:
+			current = newSection(b.text)
+			parent = current
+			chapters = append(chapters, current)
+		case b.heading == 2 && parent != nil:
+			current = newSection(b.text)
+			parent.subs = append(parent.subs, current)
+		case b.heading == 2:
+			current = newSection(b.text)
+			chapters = append(chapters, current)
+		case current == nil:
+			title := meta["title"]
+			if len(title) == 0 {
+				title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+			}
+			current = newSection(title)
+			chapters = append(chapters, current)
+		}
+		current.body.WriteString(b.html)
+	}
+
+	for _, s := range chapters {
+		c.book.Chapters = append(c.book.Chapters, s.chapter())
+	}
+
+	return nil
+}
+
+func newSection(title string) *section {
+	return &section{
+		title: title,
+		body:  new(strings.Builder),
+	}
+}
+
+func (s *section) chapter() mobi.Chapter {
+	chap := mobi.Chapter{
+		Title:  s.title,
+		Chunks: mobi.Chunks(s.body.String()),
+	}
+	for _, sub := range s.subs {
+		chap.SubChapters = append(chap.SubChapters, sub.chapter())
+	}
+
+	return chap
+}
+
+// loadImage adds the image at src relative to dir to the book and
+// returns the URI that references it.
+func (c *converter) loadImage(dir, src string) (string, error) {
+	if strings.Contains(src, ":") || strings.HasPrefix(src, "/") {
+		return src, nil
+	}
+
+	name := path.Join(dir, src)
+	if i, ok := c.images[name]; ok {
+		return c.book.ImageURI(i), nil
+	}
+	img, err := c.decodeImage(name)
+	if err != nil {
+		return "", err
+	}
+	c.images[name] = len(c.book.Images)
+	c.book.Images = append(c.book.Images, img)
+
+	return c.book.ImageURI(len(c.book.Images) - 1), nil
+}
+
+func (c *converter) decodeImage(name string) (image.Image, error) {
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("image %v: %w", name, err)
+	}
+
+	return img, nil
+}
+
+// metadataKeys lists the supported front matter keys in the order in
+// which they are applied.
+var metadataKeys = []string{
+	"title", "author", "authors", "contributor", "contributors", "publisher",
+	"subject", "lang", "language", "date", "cover",
+}
+
+func (c *converter) applyMetadata(meta map[string]string, dir string) error {
+	for _, key := range metadataKeys {
+		value, ok := meta[key]
+		if !ok {
+			continue
+		}
+		switch key {
+		case "title":
+			c.book.Title = value
+		case "author", "authors":
+			c.book.Authors = splitList(value)
+		case "contributor", "contributors":
+			c.book.Contributors = splitList(value)
+		case "publisher":
+			c.book.Publisher = value
+		case "subject":
+			c.book.Subject = value
+		case "language", "lang":
+			tag, err := language.Parse(value)
+			if err != nil {
+				return err
+			}
+			c.book.Language = tag
+		case "date":
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return err
+			}
+			c.book.PublishedDate = date
+		case "cover":
+			img, err := c.decodeImage(path.Join(dir, value))
+			if err != nil {
+				return err
+			}
+			c.book.CoverImage = img
+		}
+	}
+
+	return nil
+}
+
+// splitFrontMatter separates the front matter of a Markdown document
+// from its content.  List values are joined using newlines.
+func splitFrontMatter(text string) (map[string]string, string) {
+	meta := make(map[string]string)
+	lines := strings.Split(text, "\n")
+	if len(lines) == 0 || lines[0] != "---" {
+		return meta, text
+	}
+	end := 1
+	for end < len(lines) && lines[end] != "---" {
+		end++
+	}
+	if end == len(lines) {
+		return meta, text
+	}
+
+	key := ""
+	for _, line := range lines[1:end] {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case len(trimmed) == 0 || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "- ") && len(key) > 0:
+			item := unquote(strings.TrimSpace(trimmed[2:]))
+			meta[key] = strings.TrimPrefix(meta[key]+"\n"+item, "\n")
+		default:
+			colon := strings.IndexByte(trimmed, ':')
+			if colon < 0 {
+				continue
+			}
+			key = strings.ToLower(strings.TrimSpace(trimmed[:colon]))
+			value := strings.TrimSpace(trimmed[colon+1:])
+			if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+				items := make([]string, 0)
+				for _, item := range strings.Split(value[1:len(value)-1], ",") {
+					items = append(items, unquote(strings.TrimSpace(item)))
+				}
+				value = strings.Join(items, "\n")
+			} else {
+				value = unquote(value)
+			}
+			meta[key] = value
+		}
+	}
+
+	return meta, strings.Join(lines[end+1:], "\n")
+}
+
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, "\n") {
+		if len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
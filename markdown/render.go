@@ -0,0 +1,570 @@
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// block is a rendered block-level element.  Headings are kept separate
+// from other blocks, as they determine the chapter structure.
+type block struct {
+	heading   int
+	paragraph bool
+	text      string
+	html      string
+}
+
+// renderer converts Markdown to KF8 HTML.
+type renderer struct {
+	image func(src string) (string, error)
+	err   error
+	code  bool
+}
+
+var (
+	atxHeadingRegexp    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextRegexp        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	thematicBreakRegexp = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRegexp         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \\t]*([^`]*?)[ \\t]*$")
+	listItemRegexp      = regexp.MustCompile(`^( {0,3})([-*+]|[0-9]{1,9}[.)])(?:([ \t]+)(.*))?$`)
+	htmlBlockRegexp     = regexp.MustCompile(`^ {0,3}</?[A-Za-z][A-Za-z0-9-]*(?:[ \t/>]|$)`)
+	entityRegexp        = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	tagRegexp           = regexp.MustCompile(`<[^>]*>`)
+)
+
+// blocks renders the given lines as a list of blocks.
+func (r *renderer) blocks(lines []string) []block {
+	result := make([]block, 0)
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case fenceRegexp.MatchString(line):
+			var b block
+			b, i = r.fencedCode(lines, i)
+			result = append(result, b)
+		case indentation(line) >= 4:
+			var b block
+			b, i = r.indentedCode(lines, i)
+			result = append(result, b)
+		case atxHeadingRegexp.MatchString(line):
+			m := atxHeadingRegexp.FindStringSubmatch(line)
+			result = append(result, r.heading(len(m[1]), m[2]))
+			i++
+		case thematicBreakRegexp.MatchString(line):
+			result = append(result, block{html: "<hr/>"})
+			i++
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			var b block
+			b, i = r.blockquote(lines, i)
+			result = append(result, b)
+		case listItemRegexp.MatchString(line):
+			var b block
+			b, i = r.list(lines, i)
+			result = append(result, b)
+		case htmlBlockRegexp.MatchString(line):
+			start := i
+			for i < len(lines) && !isBlank(lines[i]) {
+				i++
+			}
+			result = append(result, block{html: strings.Join(lines[start:i], "\n")})
+		default:
+			var b block
+			b, i = r.paragraph(lines, i)
+			result = append(result, b)
+		}
+	}
+
+	return result
+}
+
+func (r *renderer) heading(level int, text string) block {
+	content := r.inline(strings.TrimSpace(text))
+	return block{
+		heading: level,
+		text:    plainText(content),
+		html:    fmt.Sprintf("<h%v>%v</h%v>", level, content, level),
+	}
+}
+
+func (r *renderer) paragraph(lines []string, i int) (block, int) {
+	start := i
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if setextRegexp.MatchString(line) {
+			level := 1
+			if strings.Contains(line, "-") {
+				level = 2
+			}
+			return r.heading(level, joinLines(lines[start:i])), i + 1
+		}
+		if interruptsParagraph(line) {
+			break
+		}
+	}
+
+	return block{
+		paragraph: true,
+		html:      "<p>" + r.inline(joinLines(lines[start:i])) + "</p>",
+	}, i
+}
+
+func interruptsParagraph(line string) bool {
+	if isBlank(line) || fenceRegexp.MatchString(line) || atxHeadingRegexp.MatchString(line) ||
+		thematicBreakRegexp.MatchString(line) || htmlBlockRegexp.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+		return true
+	}
+
+	// Only non-empty bullet items and ordered items starting at one
+	// may interrupt a paragraph
+	m := listItemRegexp.FindStringSubmatch(line)
+	return m != nil && len(m[4]) > 0 && (len(m[2]) == 1 || strings.HasPrefix(m[2], "1") && len(m[2]) == 2)
+}
+
+func (r *renderer) fencedCode(lines []string, i int) (block, int) {
+	m := fenceRegexp.FindStringSubmatch(lines[i])
+	indent, fence, info := len(m[1]), m[2], m[3]
+	code := make([]string, 0)
+	for i++; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			i++
+			break
+		}
+		code = append(code, trimIndentation(lines[i], indent))
+	}
+
+	class := ""
+	if lang := strings.Fields(info); len(lang) > 0 {
+		class = fmt.Sprintf(` class="language-%v"`, html.EscapeString(lang[0]))
+	}
+	return r.codeBlock(code, class), i
+}
+
+func (r *renderer) indentedCode(lines []string, i int) (block, int) {
+	code := make([]string, 0)
+	for ; i < len(lines) && (isBlank(lines[i]) || indentation(lines[i]) >= 4); i++ {
+		code = append(code, trimIndentation(lines[i], 4))
+	}
+	for len(code) > 0 && isBlank(code[len(code)-1]) {
+		code = code[:len(code)-1]
+	}
+
+	return r.codeBlock(code, ""), i
+}
+
+func (r *renderer) codeBlock(code []string, class string) block {
+	r.code = true
+	text := html.EscapeString(strings.Join(code, "\n"))
+	return block{html: fmt.Sprintf("<pre><code%v>%v</code></pre>", class, text)}
+}
+
+func (r *renderer) blockquote(lines []string, i int) (block, int) {
+	content := make([]string, 0)
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimLeft(lines[i], " ")
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		trimmed = strings.TrimPrefix(trimmed, ">")
+		content = append(content, strings.TrimPrefix(trimmed, " "))
+	}
+
+	return block{html: "<blockquote>" + r.join(r.blocks(content), false) + "</blockquote>"}, i
+}
+
+func (r *renderer) list(lines []string, i int) (block, int) {
+	m := listItemRegexp.FindStringSubmatch(lines[i])
+	marker := m[2]
+	ordered := len(marker) > 1
+	delimiter := marker[len(marker)-1:]
+
+	items := make([][]string, 0)
+	loose := false
+	blank := false
+	for i < len(lines) {
+		m := listItemRegexp.FindStringSubmatch(lines[i])
+		if m == nil || len(m[2]) > 1 != ordered || !strings.HasSuffix(m[2], delimiter) {
+			break
+		}
+		if blank && len(items) > 0 {
+			loose = true
+		}
+
+		// Continuation lines are indented relative to the item content,
+		// unless the content starts with an indented code block
+		padding := len(m[3])
+		if padding > 4 || len(m[4]) == 0 {
+			padding = 1
+		}
+		width := len(m[1]) + len(m[2]) + padding
+		item := []string{strings.Repeat(" ", max(len(m[3])-padding, 0)) + m[4]}
+		blank = false
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			switch {
+			case isBlank(line):
+				blank = true
+				item = append(item, "")
+				continue
+			case indentation(line) >= width:
+				item = append(item, trimIndentation(line, width))
+				blank = false
+				continue
+			case !blank && !interruptsParagraph(line) && !listItemRegexp.MatchString(line):
+				// Lazy continuation of a paragraph
+				item = append(item, line)
+				continue
+			}
+			break
+		}
+		for len(item) > 1 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		loose = loose || hasInnerBlank(item)
+		items = append(items, item)
+		if i < len(lines) && !listItemRegexp.MatchString(lines[i]) {
+			break
+		}
+	}
+
+	tag := "ul"
+	start := ""
+	if ordered {
+		tag = "ol"
+		n, _ := strconv.Atoi(strings.TrimRight(marker, ".)"))
+		if n != 1 {
+			start = fmt.Sprintf(` start="%v"`, n)
+		}
+	}
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "<%v%v>", tag, start)
+	for _, item := range items {
+		b.WriteString("<li>" + r.join(r.blocks(item), !loose) + "</li>")
+	}
+	fmt.Fprintf(b, "</%v>", tag)
+
+	return block{html: b.String()}, i
+}
+
+// hasInnerBlank reports whether the item contains a blank line
+// between two of its blocks.
+func hasInnerBlank(item []string) bool {
+	for _, line := range item[1:] {
+		if isBlank(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// join concatenates the HTML of the given blocks, omitting paragraph
+// tags if tight is set.
+func (r *renderer) join(blocks []block, tight bool) string {
+	b := new(strings.Builder)
+	for _, bl := range blocks {
+		if tight && bl.paragraph {
+			b.WriteString(strings.TrimSuffix(strings.TrimPrefix(bl.html, "<p>"), "</p>"))
+		} else {
+			b.WriteString(bl.html)
+		}
+	}
+
+	return b.String()
+}
+
+// inline renders the inline elements of the Markdown text s.
+func (r *renderer) inline(s string) string {
+	b := new(strings.Builder)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br/>\n")
+			i += 2
+		case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+		case c == ' ' && strings.HasPrefix(s[i:], "  \n"):
+			b.WriteString("<br/>\n")
+			i += 3
+		case c == '`':
+			i = r.codeSpan(b, s, i)
+		case c == '!' && strings.HasPrefix(s[i:], "!["):
+			i = r.link(b, s, i, true)
+		case c == '[':
+			i = r.link(b, s, i, false)
+		case c == '<':
+			i = r.angle(b, s, i)
+		case c == '&':
+			if m := entityRegexp.FindString(s[i:]); len(m) > 0 {
+				b.WriteString(html.EscapeString(html.UnescapeString(m)))
+				i += len(m)
+			} else {
+				b.WriteString("&amp;")
+				i++
+			}
+		case c == '*' || c == '_':
+			i = r.emphasis(b, s, i)
+		default:
+			b.WriteString(html.EscapeString(s[i : i+1]))
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+func (r *renderer) codeSpan(b *strings.Builder, s string, i int) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == '`' {
+		n++
+	}
+	fence := s[i : i+n]
+	for j := i + n; j < len(s); {
+		end := strings.Index(s[j:], fence)
+		if end < 0 {
+			break
+		}
+		end += j
+		if end+n < len(s) && s[end+n] == '`' {
+			j = end + n
+			for j < len(s) && s[j] == '`' {
+				j++
+			}
+			continue
+		}
+		code := strings.ReplaceAll(s[i+n:end], "\n", " ")
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+			code = code[1 : len(code)-1]
+		}
+		b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+		return end + n
+	}
+
+	b.WriteString(fence)
+	return i + n
+}
+
+func (r *renderer) link(b *strings.Builder, s string, i int, image bool) int {
+	open := i + 1
+	if image {
+		open++
+	}
+
+	// Find the matching bracket and the following destination
+	close := matching(s, open-1, '[', ']')
+	if close < 0 || close+1 >= len(s) || s[close+1] != '(' {
+		b.WriteString(html.EscapeString(s[i:open]))
+		return open
+	}
+	end := matching(s, close+1, '(', ')')
+	if end < 0 {
+		b.WriteString(html.EscapeString(s[i:open]))
+		return open
+	}
+	dest, title := splitDestination(s[close+2 : end])
+	label := s[open:close]
+
+	if image {
+		src := dest
+		if r.image != nil {
+			var err error
+			src, err = r.image(dest)
+			if err != nil && r.err == nil {
+				r.err = err
+			}
+		}
+		fmt.Fprintf(b, `<img src="%v" alt="%v"`, html.EscapeString(src), html.EscapeString(plainText(r.inline(label))))
+		if len(title) > 0 {
+			fmt.Fprintf(b, ` title="%v"`, html.EscapeString(title))
+		}
+		b.WriteString("/>")
+	} else {
+		fmt.Fprintf(b, `<a href="%v"`, html.EscapeString(dest))
+		if len(title) > 0 {
+			fmt.Fprintf(b, ` title="%v"`, html.EscapeString(title))
+		}
+		b.WriteString(">" + r.inline(label) + "</a>")
+	}
+
+	return end + 1
+}
+
+// angle renders autolinks and passes through inline HTML tags.
+func (r *renderer) angle(b *strings.Builder, s string, i int) int {
+	end := strings.IndexByte(s[i:], '>')
+	if end < 0 {
+		b.WriteString("&lt;")
+		return i + 1
+	}
+	inner := s[i+1 : i+end]
+	switch {
+	case strings.Contains(inner, "://") && !strings.ContainsAny(inner, " <"):
+		fmt.Fprintf(b, `<a href="%v">%v</a>`, html.EscapeString(inner), html.EscapeString(inner))
+	case strings.Contains(inner, "@") && !strings.ContainsAny(inner, " <"):
+		fmt.Fprintf(b, `<a href="mailto:%v">%v</a>`, html.EscapeString(inner), html.EscapeString(inner))
+	case htmlBlockRegexp.MatchString(s[i:]):
+		b.WriteString(s[i : i+end+1])
+	default:
+		b.WriteString("&lt;")
+		return i + 1
+	}
+
+	return i + end + 1
+}
+
+func (r *renderer) emphasis(b *strings.Builder, s string, i int) int {
+	c := s[i]
+	n := 0
+	for i+n < len(s) && s[i+n] == c {
+		n++
+	}
+	delim := s[i : i+n]
+
+	// Opening delimiters must be followed by non-whitespace, and
+	// underscores must not be intraword
+	canOpen := n <= 3 && i+n < len(s) && !isSpace(s[i+n])
+	if c == '_' && i > 0 && isAlnum(s[i-1]) {
+		canOpen = false
+	}
+	if canOpen {
+		for j := i + n; j < len(s); j++ {
+			if !strings.HasPrefix(s[j:], delim) || isSpace(s[j-1]) {
+				continue
+			}
+			if j+n < len(s) && s[j+n] == c || c == '_' && j+n < len(s) && isAlnum(s[j+n]) {
+				continue
+			}
+			content := r.inline(s[i+n : j])
+			switch n {
+			case 1:
+				b.WriteString("<em>" + content + "</em>")
+			case 2:
+				b.WriteString("<strong>" + content + "</strong>")
+			case 3:
+				b.WriteString("<strong><em>" + content + "</em></strong>")
+			}
+			return j + n
+		}
+	}
+
+	b.WriteString(delim)
+	return i + n
+}
+
+// matching returns the position of the bracket closing the one at
+// position i, or -1 if there is none.
+func matching(s string, i int, open, close byte) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+
+	return -1
+}
+
+func splitDestination(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	dest, title := s, ""
+	if strings.HasPrefix(s, "<") {
+		if end := strings.IndexByte(s, '>'); end > 0 {
+			dest, title = s[1:end], strings.TrimSpace(s[end+1:])
+		}
+	} else if space := strings.IndexAny(s, " \t\n"); space > 0 {
+		dest, title = s[:space], strings.TrimSpace(s[space:])
+	}
+	if len(title) >= 2 {
+		title = title[1 : len(title)-1]
+	}
+
+	return dest, title
+}
+
+// plainText returns the text content of the rendered HTML s.
+func plainText(s string) string {
+	return html.UnescapeString(tagRegexp.ReplaceAllString(s, ""))
+}
+
+func joinLines(lines []string) string {
+	trimmed := make([]string, 0)
+	for _, line := range lines {
+		trimmed = append(trimmed, strings.TrimLeft(line, " \t"))
+	}
+
+	return strings.TrimRight(strings.Join(trimmed, "\n"), " \t")
+}
+
+func indentation(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4 - n%4
+		default:
+			return n
+		}
+	}
+
+	return n
+}
+
+// trimIndentation removes up to n columns of indentation from line.
+func trimIndentation(line string, n int) string {
+	col := 0
+	for i, c := range line {
+		if col >= n || c != ' ' && c != '\t' {
+			return strings.Repeat(" ", max(col-n, 0)) + line[i:]
+		}
+		if c == '\t' {
+			col += 4 - col%4
+		} else {
+			col++
+		}
+	}
+
+	return ""
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,285 @@
+package mobi
+
+import (
+	"crypto/sha256"
+	"image"
+	"regexp"
+	"strconv"
+
+	r "github.com/leotaku/mobi/records"
+)
+
+// Merge combines the given books into a single omnibus book with the
+// given title, for example in order to bundle the books of a series.
+//
+// The chapters of every book are nested under a top-level chapter
+// named after the book.  Images and flows of all books are combined,
+// where identical images and flows are only stored once.  Accordingly,
+// "kindle:embed" URIs in chunks and flows and "kindle:flow" URIs in
+// chunks are updated.  Chapters only link the stylesheets of the book
+// they originate from, so the styles of different books do not
+// interfere.
+//
+// All other metadata, including the cover image, is taken from the
+// first book, except for authors and contributors, which are combined
+// from all books.
+func Merge(title string, books ...Book) Book {
+	if len(books) == 0 {
+		return Book{Title: title}
+	}
+
+	result := books[0]
+	result.Title = title
+	result.Authors = nil
+	result.Contributors = nil
+	result.Chapters = nil
+	result.CSSFlows = nil
+	result.Flows = nil
+	result.Images = nil
+	result.StartReading = nil
+	result.skeleton = nil
+	result.periodical = nil
+	result.sample = false
+
+	mg := merger{
+		result: &result,
+		images: make(map[[sha256.Size]byte]int),
+		flows:  make(map[Flow]int),
+	}
+	for i, book := range books {
+		if i == 0 && book.StartReading != nil {
+			// Account for the chapter that wraps the first book
+			start := *book.StartReading
+			start.Chapter++
+			result.StartReading = &start
+		}
+		result.Authors = appendUnique(result.Authors, book.Authors...)
+		result.Contributors = appendUnique(result.Contributors, book.Contributors...)
+		mg.add(book, i == 0)
+	}
+
+	return mg.build()
+}
+
+// merger accumulates the content of books that are merged.
+//
+// Flows are collected separately from the result, as the identifiers
+// of all flows depend on the number of CSS flows of all books.
+type merger struct {
+	result   *Book
+	images   map[[sha256.Size]byte]int
+	flows    map[Flow]int
+	allFlows []Flow
+	pending  []pendingBook
+}
+
+// pendingBook is a merged book whose flow references have not yet
+// been resolved.
+type pendingBook struct {
+	chapter Chapter
+	flows   []int
+}
+
+// Cover and thumbnail images of the result are stored after all other
+// images, so references to them are replaced by placeholders until the
+// number of images is known.
+const (
+	coverPlaceholder = 1<<20 - 3
+	thumbPlaceholder = 1<<20 - 2
+)
+
+func (mg *merger) add(m Book, first bool) {
+	// Map all images of the book, including cover and thumbnail
+	// images, which are stored after all other images
+	all := m.Images[:len(m.Images):len(m.Images)]
+	ids := make(map[int]int)
+	for i, img := range m.Images {
+		ids[i] = mg.addImage(img)
+	}
+	for i, img := range []image.Image{m.CoverImage, m.ThumbImage} {
+		if img != nil {
+			if first {
+				// The first book keeps its cover and thumbnail
+				ids[len(all)] = coverPlaceholder + i
+			}
+			all = append(all, img)
+		}
+	}
+	m = m.rewriteReferences(func(uri string) string {
+		i, ok := parseEmbed(uri)
+		if !ok || i >= len(all) {
+			return uri
+		}
+		if _, ok := ids[i]; !ok {
+			ids[i] = mg.addImage(all[i])
+		}
+		return mg.result.ImageURI(ids[i])
+	})
+
+	flows := make([]int, 0)
+	for _, flow := range m.flows() {
+		flows = append(flows, mg.addFlow(flow))
+	}
+
+	skeleton := DefaultSkeleton
+	if m.skeleton != nil {
+		skeleton = m.skeleton
+	}
+	mg.pending = append(mg.pending, pendingBook{
+		chapter: Chapter{
+			Title:       m.Title,
+			SubChapters: withSkeleton(m.Chapters, skeleton),
+		},
+		flows: flows,
+	})
+}
+
+func (mg *merger) addImage(img image.Image) int {
+	h := sha256.New()
+	hashImage(h, img)
+	key := [sha256.Size]byte{}
+	copy(key[:], h.Sum(nil))
+	if i, ok := mg.images[key]; ok {
+		return i
+	}
+
+	mg.images[key] = len(mg.result.Images)
+	mg.result.Images = append(mg.result.Images, img)
+
+	return len(mg.result.Images) - 1
+}
+
+func (mg *merger) addFlow(flow Flow) int {
+	if i, ok := mg.flows[flow]; ok {
+		return i
+	}
+
+	mg.flows[flow] = len(mg.allFlows)
+	mg.allFlows = append(mg.allFlows, flow)
+
+	return len(mg.allFlows) - 1
+}
+
+// build resolves the flow references of all merged books, where CSS
+// flows of the result precede all other flows.
+func (mg *merger) build() Book {
+	ids := make([]int, len(mg.allFlows))
+	for i, flow := range mg.allFlows {
+		if flow.MIME == "text/css" {
+			ids[i] = len(mg.result.CSSFlows)
+			mg.result.CSSFlows = append(mg.result.CSSFlows, flow.Content)
+		}
+	}
+	for i, flow := range mg.allFlows {
+		if flow.MIME != "text/css" {
+			ids[i] = len(mg.result.CSSFlows) + len(mg.result.Flows)
+			mg.result.Flows = append(mg.result.Flows, flow)
+		}
+	}
+	flows := mg.result.flows()
+
+	for _, p := range mg.pending {
+		stylesheets := make([]string, 0)
+		for _, i := range p.flows {
+			if flows[ids[i]].MIME == "text/css" {
+				stylesheets = append(stylesheets, flowURI(ids[i]+1, "text/css"))
+			}
+		}
+		chapter := p.chapter
+		chapter.SubChapters = rewriteFlowReferences(chapter.SubChapters, func(uri string) string {
+			i, ok := parseFlow(uri)
+			if !ok || i >= len(p.flows) {
+				return uri
+			}
+			return "kindle:flow:" + r.To32(ids[p.flows[i]]+1)
+		}, stylesheets)
+		mg.result.Chapters = append(mg.result.Chapters, chapter)
+	}
+
+	covers := make(map[int]int)
+	next := len(mg.result.Images)
+	for i, img := range []image.Image{mg.result.CoverImage, mg.result.ThumbImage} {
+		if img != nil {
+			covers[coverPlaceholder+i] = next
+			next++
+		}
+	}
+
+	return mg.result.rewriteReferences(func(uri string) string {
+		i, ok := parseEmbed(uri)
+		if id, placeholder := covers[i]; ok && placeholder {
+			return mg.result.ImageURI(id)
+		}
+		return uri
+	})
+}
+
+var flowRegexp = regexp.MustCompile(`kindle:flow:([0-9A-Va-v]{4})`)
+
+// parseFlow returns the index of the secondary flow referenced by a
+// "kindle:flow" URI.
+func parseFlow(uri string) (int, bool) {
+	m := flowRegexp.FindStringSubmatch(uri)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(m[1], 32, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+
+	return int(id) - 1, true
+}
+
+// rewriteFlowReferences replaces all "kindle:flow" URIs in the chunks
+// of the chapters using f and restricts the stylesheets linked by
+// their skeletons to the given URIs.
+func rewriteFlowReferences(chapters []Chapter, f func(uri string) string, stylesheets []string) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		chunks := make([]Chunk, 0)
+		for _, chunk := range chap.Chunks {
+			chunk.Body = flowRegexp.ReplaceAllStringFunc(chunk.Body, f)
+			chunks = append(chunks, chunk)
+		}
+		chap.Chunks = chunks
+		skeleton := chap.skeleton
+		chap.skeleton = func(inv Inventory) (string, error) {
+			inv.Stylesheets = stylesheets
+			return skeleton(inv)
+		}
+		chap.SubChapters = rewriteFlowReferences(chap.SubChapters, f, stylesheets)
+		result = append(result, chap)
+	}
+
+	return result
+}
+
+// withSkeleton returns a copy of the chapters in which all chapters
+// without a skeleton override use the given skeleton.
+func withSkeleton(chapters []Chapter, skeleton SkeletonFunc) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		if chap.skeleton == nil {
+			chap.skeleton = skeleton
+		}
+		chap.SubChapters = withSkeleton(chap.SubChapters, skeleton)
+		result = append(result, chap)
+	}
+
+	return result
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, other := range list {
+			found = found || other == item
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
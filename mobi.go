@@ -21,45 +21,72 @@ import (
 // variables and/or builder pattern, then convert the resulting
 // structure into a PalmDB database.  This database can then be
 // written out to any io.Writer.
+//
+// The ASIN is written to EXTH record 113, and additionally to EXTH
+// record 504 when DuplicateASIN is set.  Setting OmitASIN leaves out
+// record 113, so that DuplicateASIN alone writes only record 504.
+//
+// InputLanguage and OutputLanguage are only meaningful for
+// dictionaries, where they are the languages of the headwords and of
+// their definitions.  They are left unset for other books.
 type Book struct {
-	Title         string
-	Authors       []string
-	Contributors  []string
-	Publisher     string
-	Subject       string
-	CreatedDate   time.Time
-	PublishedDate time.Time
-	DocType       string
-	Language      language.Tag
-	FixedLayout   bool
-	RightToLeft   bool
-	Vertical      bool
-	Chapters      []Chapter
-	CSSFlows      []string
-	Images        []image.Image
-	CoverImage    image.Image
-	ThumbImage    image.Image
-	UniqueID      uint32
+	Title          string
+	Authors        []string
+	Contributors   []string
+	Publisher      string
+	Subject        string
+	CreatedDate    time.Time
+	PublishedDate  time.Time
+	DocType        string
+	Language       language.Tag
+	InputLanguage  language.Tag
+	OutputLanguage language.Tag
+	FixedLayout    bool
+	RightToLeft    bool
+	Vertical       bool
+	EmbedSpine     bool
+	Chapters       []Chapter
+	CSSFlows       []string
+	Flows          []Flow
+	Images         []image.Image
+	CoverImage     image.Image
+	ThumbImage     image.Image
+	ImageProfile   ImageProfile
+	CoverProfile   *ImageProfile
+	SourceArchive  []byte
+	UniqueID       uint32
+	ASIN           string
+	DuplicateASIN  bool
+	OmitASIN       bool
+	StartReading   *StartLocation
 
 	// hidden
-	tpl *template.Template
+	skeleton   SkeletonFunc
+	periodical *Periodical
+	sample     bool
 }
 
 // OverrideTemplate overrides the template used in order to generate
-// the skeleton section of a KF8 HTML chunk.
+// the skeleton section of a KF8 HTML file.
 //
 // During conversion to a PalmDB database, this template is passed the
-// internal inventory type.  If the template cannot successfully be
-// applied, the conversion will panic.
-//
-// The skeleton section generally consists of a complete HTML document
-// including head and body, with the body tag expected to contain an
-// 'aid' attribute that indicates the identifier of the corresponding
-// chunk.  As it is relatively easy to end up with an invalid KF8
-// document by generating invalid skeleton sections, this option is
-// private and hidden behind a setter function.
+// Inventory type.  It is equivalent to calling OverrideSkeleton with
+// the result of TemplateSkeleton.
 func (m *Book) OverrideTemplate(tpl template.Template) Book {
-	m.tpl = &tpl
+	m.skeleton = TemplateSkeleton(tpl)
+	return *m
+}
+
+// OverrideSkeleton overrides the function used in order to generate
+// the skeleton section of a KF8 HTML file.
+//
+// As it is relatively easy to end up with an invalid KF8 document by
+// generating invalid skeleton sections, this option is private and
+// hidden behind a setter function.  Skeleton generation can also be
+// overridden for individual chapters, which takes precedence over
+// this option.
+func (m *Book) OverrideSkeleton(f SkeletonFunc) Book {
+	m.skeleton = f
 	return *m
 }
 
@@ -73,39 +100,133 @@ func (m *Book) OverrideTemplate(tpl template.Template) Book {
 // However, we can still get covers for sideloaded books by embedding
 // a fake ASIN identification string and manually copying an image to
 // the corresponding location inside the Kindle thumbnails folder.
+//
+// Unless the ASIN field is set, a fake ASIN identification string is
+// derived from the UniqueID of the book.
 func (m Book) GetThumbFilename() string {
-	asin := encodeASIN(m.UniqueID)
-	return fmt.Sprintf("thumbnail_%v_EBOK_portrait.jpg", asin)
+	return fmt.Sprintf("thumbnail_%v_%v_portrait.jpg", m.asin(), m.cdeType())
 }
 
 // Chapter represents a chapter in a Book.
+//
+// Chapters may contain SubChapters, which are placed after the chunks
+// of the chapter itself and appear as nested entries in the table of
+// contents.  Every chapter or sub-chapter with chunks is converted to
+// its own HTML file.
 type Chapter struct {
-	Title  string
-	Chunks []Chunk
+	Title       string
+	Chunks      []Chunk
+	PageSpread  PageSpread
+	SubChapters []Chapter
+
+	// hidden
+	skeleton SkeletonFunc
+}
+
+// OverrideSkeleton overrides the function used in order to generate
+// the skeleton section of the KF8 HTML file for this chapter.
+//
+// This may be used to add chapter-specific stylesheets or metadata,
+// such as viewport information for fixed-layout pages.
+func (c *Chapter) OverrideSkeleton(f SkeletonFunc) Chapter {
+	c.skeleton = f
+	return *c
+}
+
+// PageSpread describes on which side of a two-page spread a Chapter
+// should be displayed in a fixed-layout book.
+//
+// This information is only stored in the generated book if the
+// EmbedSpine option has been set.
+type PageSpread int
+
+const (
+	PageSpreadAuto PageSpread = iota
+	PageSpreadLeft
+	PageSpreadRight
+	PageSpreadCenter
+)
+
+func (p PageSpread) property() string {
+	switch p {
+	case PageSpreadLeft:
+		return "page-spread-left"
+	case PageSpreadRight:
+		return "page-spread-right"
+	case PageSpreadCenter:
+		return "rendition:page-spread-center"
+	default:
+		return ""
+	}
 }
 
 // Chunk represents a chunk of text in a Chapter.
 //
 // Chunks are mostly an implementation detail that is exposed for
-// maximum control over the final book output.  Generally, you should
-// use one of the various "Chunks" functions in order to generate the
-// correct amount of chunks for a chapter.
+// maximum control over the final book output.  All chunks of a
+// chapter share one skeleton section, so markup may not span chunk
+// boundaries.  Generally, you should use one of the various "Chunks"
+// functions in order to generate the correct amount of chunks for a
+// chapter.
 type Chunk struct {
 	Body string
 }
 
 // Realize converts a Book to a PalmDB Database.
+//
+// Panics if the book cannot be converted, which can only happen if a
+// skeleton section or image cannot be generated.  Use TryRealize in
+// order to handle such errors.
 func (m Book) Realize() pdb.Database {
-	db := pdb.NewDatabase(m.Title, m.CreatedDate)
-	html, chunks, chaps, err := chaptersToText(m)
-	text := html + strings.Join(m.CSSFlows, "")
-	textRecords := textToRecords(text, chaps)
-
-	// Handle possible template errors
+	db, err := m.TryRealize()
 	if err != nil {
 		panic(err)
 	}
 
+	return db
+}
+
+// TryRealize converts a Book to a PalmDB Database.
+//
+// Returns an error if a skeleton section or image cannot be generated
+// or if the start location does not refer to any content.
+func (m Book) TryRealize() (pdb.Database, error) {
+	db := pdb.NewDatabase(m.Title, m.CreatedDate)
+	html, skels, chunks, chaps, err := chaptersToText(m)
+	if err != nil {
+		return db, err
+	}
+	flows := []string{html}
+	for _, flow := range m.flows() {
+		flows = append(flows, flow.Content)
+	}
+	text := strings.Join(flows, "")
+
+	// Start location
+	startPos := -1
+	guide := make([]r.GuideInfo, 0)
+	if m.StartReading != nil {
+		pos, fid, offset, err := m.startPosition(html, skels, chunks)
+		if err != nil {
+			return db, err
+		}
+		startPos = pos
+		guide = append(guide, r.GuideInfo{
+			Type:   "text",
+			Title:  "Start Reading",
+			FID:    fid,
+			Offset: offset,
+		})
+	}
+
+	// Trailing entries only refer to top-level chapters, which are
+	// the first entries of the NCX index
+	textRecords := textToRecords(text, chaps)
+	if m.periodical != nil {
+		// Trailing entries do not support periodical hierarchies
+		textRecords = textToRecords(text, nil)
+	}
+
 	// Null record
 	null := m.createNullRecord()
 	db.AddRecord(null)
@@ -128,47 +249,51 @@ func (m Book) Realize() pdb.Database {
 	}
 	null.MOBIHeader.FirstNonBookIndex = uint32(db.Idx() + 1)
 
-	// Chunk record
-	chunk, cncx := r.ChunkIndexRecord(chunks)
-	ch := r.ChunkHeaderIndexRecord(len(text), len(chunks))
-	null.MOBIHeader.ChunkIndex = uint32(db.AddRecord(ch))
-	db.AddRecord(chunk)
-	db.AddRecord(cncx)
-
-	// Skeleton record
-	skeleton := r.SkeletonIndexRecord(chunks)
-	sh := r.SkeletonHeaderIndexRecord(len(skeleton.IDXTEntries))
-	null.MOBIHeader.SkeletonIndex = uint32(db.AddRecord(sh))
-	db.AddRecord(skeleton)
-
-	// NCX record
-	ncx, cncx := r.NCXIndexRecord(chaps)
-	nh := r.NCXHeaderIndexRecord(len(chaps))
-	null.MOBIHeader.INDXRecordOffset = uint32(db.AddRecord(nh))
-	db.AddRecord(ncx)
-	db.AddRecord(cncx)
-
-	// Image records
-	images := m.Images
-	if m.CoverImage != nil {
-		images = append(images, m.CoverImage)
+	// Chunk index
+	null.MOBIHeader.ChunkIndex = addIndex(&db, r.ChunkIndex(chunks))
+
+	// Skeleton index
+	null.MOBIHeader.SkeletonIndex = addIndex(&db, r.SkeletonIndex(skels))
+
+	// NCX index
+	if m.periodical != nil {
+		info := m.periodical.info(chaps)
+		null.MOBIHeader.INDXRecordOffset = addIndex(&db, r.PeriodicalIndex(info))
+	} else {
+		null.MOBIHeader.INDXRecordOffset = addIndex(&db, r.NCXIndex(chaps))
 	}
-	if m.ThumbImage != nil {
-		images = append(images, m.ThumbImage)
+
+	// Guide index
+	if len(guide) > 0 {
+		null.MOBIHeader.GuideIndex = addIndex(&db, r.GuideIndex(guide))
 	}
-	if len(images) > 0 {
+	if startPos >= 0 {
+		null.EXTHSection.AddInt(t.EXTHStartReading, startPos)
+	}
+
+	// Resource records
+	images, err := m.imageRecords()
+	if err != nil {
+		return db, err
+	}
+	resources := make([]pdb.Record, 0)
+	for _, rec := range images {
+		resources = append(resources, rec)
+	}
+	if m.EmbedSpine {
+		resources = append(resources, m.createRESCRecord())
+	}
+	if len(resources) > 0 {
 		null.MOBIHeader.FirstImageIndex = uint32(db.Idx() + 1)
-		null.EXTHSection.AddInt(t.EXTHKF8CountResources, len(images))
+		null.EXTHSection.AddInt(t.EXTHKF8CountResources, len(resources))
 	}
-	for _, img := range images {
-		rec := r.NewImageRecord(img)
+	for _, rec := range resources {
 		db.AddRecord(rec)
 	}
 
 	// FDST Record
-	flows := append([]string{html}, m.CSSFlows...)
 	db.AddRecord(r.NewFDSTRecord(flows...))
-	null.MOBIHeader.Unknown3OrFDSTEntryCount = uint32(len(m.CSSFlows) + 1)
+	null.MOBIHeader.Unknown3OrFDSTEntryCount = uint32(len(flows))
 	null.MOBIHeader.FirstContentRecordNumberOrFDSTNumberMSB = 0
 	null.MOBIHeader.LastContentRecordNumberOrFDSTNumberLSB = uint16(db.Idx())
 
@@ -182,11 +307,74 @@ func (m Book) Realize() pdb.Database {
 	null.MOBIHeader.FCISRecordCount = 1
 	null.MOBIHeader.FCISRecordNumber = uint32(db.Idx())
 
+	// SRCS Record
+	if len(m.SourceArchive) > 0 {
+		db.AddRecord(r.NewSRCSRecord(m.SourceArchive))
+		null.MOBIHeader.FirstCompilationSectionCount = 1
+		null.MOBIHeader.Unknown5 = uint32(db.Idx())
+	}
+
 	// Replace updated Null record
 	db.AddRecord(t.EOFRecord)
 	db.ReplaceRecord(0, null)
 
-	return db
+	return db, nil
+}
+
+func (m Book) imageRecords() ([]r.ImageRecord, error) {
+	coverProfile := m.ImageProfile
+	if m.CoverProfile != nil {
+		coverProfile = *m.CoverProfile
+	}
+
+	images := make([]image.Image, 0)
+	profiles := make([]ImageProfile, 0)
+	for _, img := range m.Images {
+		images = append(images, img)
+		profiles = append(profiles, m.ImageProfile)
+	}
+	for _, img := range []image.Image{m.CoverImage, m.ThumbImage} {
+		if img != nil {
+			images = append(images, img)
+			profiles = append(profiles, coverProfile)
+		}
+	}
+
+	records := make([]r.ImageRecord, 0)
+	for i, img := range images {
+		var rec r.ImageRecord
+		var err error
+		if raw, ok := img.(RawImage); ok {
+			rec, err = r.NewRawImageRecord(raw.Data, raw.Options)
+		} else {
+			rec, err = profiles[i].Record(img)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+func (m Book) createRESCRecord() r.RESCRecord {
+	direction := "ltr"
+	if m.RightToLeft {
+		direction = "rtl"
+	}
+
+	items := make([]r.SpineItem, 0)
+	for _, chap := range flattenChapters(m.Chapters) {
+		if len(chap.Chunks) > 0 {
+			items = append(items, r.SpineItem{
+				SkeletonID: len(items),
+				Properties: chap.PageSpread.property(),
+			})
+		}
+	}
+
+	return r.NewRESCRecord(direction, items)
 }
 
 func (m Book) createNullRecord() r.NullRecord {
@@ -195,26 +383,41 @@ func (m Book) createNullRecord() r.NullRecord {
 	lastImageID := len(m.Images)
 	null.MOBIHeader.UniqueID = m.UniqueID
 	null.MOBIHeader.Locale = matchLocale(m.Language)
+	if m.InputLanguage != language.Und {
+		null.MOBIHeader.InputLanguage = matchLocale(m.InputLanguage)
+	}
+	if m.OutputLanguage != language.Und {
+		null.MOBIHeader.OutputLanguage = matchLocale(m.OutputLanguage)
+	}
+	if m.periodical != nil {
+		null.MOBIHeader.MOBIType = m.periodical.mobiType()
+	}
 
 	// EXTH header
-	lang, _ := m.Language.Base()
 	null.EXTHSection.AddString(t.EXTHTitle, m.Title)
 	null.EXTHSection.AddString(t.EXTHUpdatedTitle, m.Title)
 	null.EXTHSection.AddString(t.EXTHAuthor, m.Authors...)
 	null.EXTHSection.AddString(t.EXTHContributor, m.Contributors...)
 	null.EXTHSection.AddString(t.EXTHPublisher, m.Publisher)
 	null.EXTHSection.AddString(t.EXTHSubject, m.Subject)
-	null.EXTHSection.AddString(t.EXTHASIN, encodeASIN(m.UniqueID))
-	null.EXTHSection.AddString(t.EXTHLanguage, lang.String())
+	if !m.OmitASIN {
+		null.EXTHSection.AddString(t.EXTHASIN, m.asin())
+	}
+	if m.DuplicateASIN {
+		null.EXTHSection.AddString(t.EXTHASIN5XX, m.asin())
+	}
+	null.EXTHSection.AddString(t.EXTHLanguage, m.Language.String())
+	if m.InputLanguage != language.Und {
+		null.EXTHSection.AddString(t.EXTHDictLangInput, m.InputLanguage.String())
+	}
+	if m.OutputLanguage != language.Und {
+		null.EXTHSection.AddString(t.EXTHDictLangOutput, m.OutputLanguage.String())
+	}
 	if m.PublishedDate != (time.Time{}) {
 		dateString := m.PublishedDate.Format("2006-01-02T15:04:05.000000+07:00")
 		null.EXTHSection.AddString(t.EXTHPublishingDate, dateString)
 	}
-	if len(m.DocType) > 0 {
-		null.EXTHSection.AddString(t.EXTHDocType, m.DocType)
-	} else {
-		null.EXTHSection.AddString(t.EXTHDocType, "EBOK")
-	}
+	null.EXTHSection.AddString(t.EXTHDocType, m.cdeType())
 	if m.FixedLayout {
 		null.EXTHSection.AddString(t.EXTHFixedLayout, "true")
 	}
@@ -235,10 +438,21 @@ func (m Book) createNullRecord() r.NullRecord {
 	if m.ThumbImage != nil {
 		null.EXTHSection.AddInt(t.EXTHThumbOffset, lastImageID)
 	}
+	if m.sample {
+		null.EXTHSection.AddInt(t.EXTHSample, 1)
+	}
 
 	return null
 }
 
+func (m Book) cdeType() string {
+	if len(m.DocType) > 0 {
+		return m.DocType
+	}
+
+	return DocTypeEBOK
+}
+
 func encodeASIN(id uint32) string {
 	return fmt.Sprintf("%015x", id)
 }
@@ -1,12 +1,36 @@
 package mobi_test
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/leotaku/mobi"
+	"github.com/leotaku/mobi/apnx"
+	"github.com/leotaku/mobi/edit"
+	"github.com/leotaku/mobi/epub"
+	"github.com/leotaku/mobi/jfif"
+	"github.com/leotaku/mobi/markdown"
+	"github.com/leotaku/mobi/palmdoc"
 	"github.com/leotaku/mobi/pdb"
+	"github.com/leotaku/mobi/records"
+	"github.com/leotaku/mobi/types"
+	"github.com/leotaku/mobi/xhtml"
+	"golang.org/x/text/language"
 )
 
 func TestPDBHeaderLength(t *testing.T) {
@@ -71,3 +95,1133 @@ func measure(v interface{}) int {
 
 	return len(buf.Bytes())
 }
+
+func TestImageProfileSizeLimit(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1200, 1200))
+	rng := rand.New(rand.NewSource(0))
+	rng.Read(img.Pix)
+
+	rec, err := mobi.ImageProfile{MaxWidth: 1000, Grayscale: true}.Record(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := writeRecord(rec)
+	if len(bs) > records.ImageRecordMaxSize {
+		t.Errorf("Image record too large: %v", len(bs))
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, decoded.Bounds().Dx() <= 1000, true)
+	assertEq(t, decoded.ColorModel(), color.GrayModel)
+}
+
+func TestJFIFRewrite(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif := []byte{0xFF, 0xE1, 0x00, 0x08, 'E', 'x', 'i', 'f', 0x00, 0x00}
+	raw := append(append([]byte{0xFF, 0xD8}, exif...), buf.Bytes()[2:]...)
+
+	w := bytes.NewBuffer(nil)
+	o := &jfif.Options{Units: jfif.DotsPerInch, XDensity: 300, YDensity: 300, StripEXIF: true}
+	err = jfif.Rewrite(w, raw, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := w.Bytes()
+	assertEq(t, string(bs[6:11]), "JFIF\x00")
+	assertEq(t, jfif.Units(bs[13]), jfif.DotsPerInch)
+	assertEq(t, pdb.Endian.Uint16(bs[14:]), uint16(300))
+	assertEq(t, bytes.Contains(bs, []byte("Exif")), false)
+	_, err = jpeg.Decode(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Raw records are subject to the same size limit as encoded images
+	app := append([]byte{0xFF, 0xE2, 0xC3, 0x52}, make([]byte, 50000)...)
+	large := append([]byte{0xFF, 0xD8}, bytes.Repeat(app, 3)...)
+	large = append(large, buf.Bytes()[2:]...)
+	_, err = records.NewRawImageRecord(large, nil)
+	assertEq(t, errors.Is(err, records.ErrImageRecordTooLarge), true)
+
+	// Raw images of a book are rewritten with their own options
+	img, err := mobi.NewRawImage(raw, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := testBook()
+	mb.Images = []image.Image{img}
+	mb.CoverImage = image.NewGray(image.Rect(0, 0, 8, 8))
+	db, err := mb.TryRealize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	null := mustReadNull(t, &db)
+	first := int(null.MOBIHeader.FirstImageIndex)
+	assertEq(t, bytes.Equal(writeRecord(db.Records[first]), bs), true)
+	assertEq(t, writeRecord(db.Records[first+1])[13], byte(jfif.NoUnits))
+
+	mb.Images = []image.Image{mobi.RawImage{Image: img, Data: large}}
+	_, err = mb.TryRealize()
+	assertEq(t, errors.Is(err, records.ErrImageRecordTooLarge), true)
+
+	w.Reset()
+	err = jfif.Encode(w, image.NewGray(image.Rect(0, 0, 8, 8)), &jpeg.Options{Quality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, string(w.Bytes()[6:11]), "JFIF\x00")
+}
+
+func TestSourceArchive(t *testing.T) {
+	mb := testBook()
+	mb.SourceArchive = []byte("PK\x03\x04 source")
+	rdb := roundTrip(t, mb.Realize())
+
+	src, err := mobi.ReadSourceArchive(*rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, string(src), string(mb.SourceArchive))
+
+	_, err = mobi.ReadSourceArchive(*roundTrip(t, testBook().Realize()))
+	assertEq(t, err, mobi.ErrNoSourceArchive)
+}
+
+func testBook() mobi.Book {
+	ch := mobi.Chapter{
+		Title:  "Chapter 1",
+		Chunks: mobi.Chunks(`<p>Lorem ipsum dolor sit amet, consetetur sadipscing elitr.</p>`),
+	}
+	return mobi.Book{
+		Title:       "Test Book",
+		Authors:     []string{"Sueton"},
+		CreatedDate: time.Unix(0, 0),
+		Chapters:    []mobi.Chapter{ch},
+		UniqueID:    42,
+	}
+}
+
+func roundTrip(t *testing.T, db pdb.Database) *pdb.Database {
+	w := bytes.NewBuffer(nil)
+	err := db.Write(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := pdb.ReadDatabase(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rdb
+}
+
+func TestPageMap(t *testing.T) {
+	marker := `<span class="pagebreak"/>`
+	mb := testBook()
+	mb.Chapters[0].Chunks = mobi.Chunks("<p>One</p>"+marker+"<p>Two</p>", marker+"<p>Three</p>")
+
+	pm, err := mb.PageMap(func(text string) []int {
+		pages := apnx.PagesFromMarkers(text, marker)
+		for _, offset := range pages[1:] {
+			assertEq(t, text[offset:offset+len(marker)], marker)
+		}
+		return pages
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(pm.Pages), 3)
+	assertEq(t, len(apnx.PagesFromLength("<p>abcdef</p>", 2)), 3)
+}
+
+func TestWriteToKindle(t *testing.T) {
+	dir := t.TempDir()
+	mb := testBook()
+	mb.CoverImage = image.NewRGBA(image.Rect(0, 0, 600, 800))
+	err := mb.WriteToKindle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "documents", "Test Book.azw3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "system", "thumbnails", mb.GetThumbFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, cfg.Height, 440)
+}
+
+func TestASINFromISBN(t *testing.T) {
+	asin, err := mobi.ASINFromISBN("978-0-306-40615-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, asin, "0306406152")
+
+	asin, err = mobi.ASINFromISBN("0-8044-2957-X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, asin, "080442957X")
+
+	_, err = mobi.ASINFromISBN("979-10-90636-07-1")
+	assertEq(t, err, mobi.ErrInvalidISBN)
+}
+
+func TestDuplicateASIN(t *testing.T) {
+	mb := testBook()
+	mb.ASIN = "B000000001"
+	db := mb.Realize()
+	null := mustReadNull(t, &db)
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHASIN), ", "), "B000000001")
+	assertEq(t, len(null.EXTHSection.Strings(types.EXTHASIN5XX)), 0)
+
+	mb.DuplicateASIN = true
+	db = mb.Realize()
+	null = mustReadNull(t, &db)
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHASIN), ", "), "B000000001")
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHASIN5XX), ", "), "B000000001")
+
+	mb.OmitASIN = true
+	db = mb.Realize()
+	null = mustReadNull(t, &db)
+	assertEq(t, len(null.EXTHSection.Strings(types.EXTHASIN)), 0)
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHASIN5XX), ", "), "B000000001")
+
+	mb.DuplicateASIN = false
+	db = mb.Realize()
+	null = mustReadNull(t, &db)
+	assertEq(t, len(null.EXTHSection.Strings(types.EXTHASIN)), 0)
+	assertEq(t, len(null.EXTHSection.Strings(types.EXTHASIN5XX)), 0)
+}
+
+func TestReproducible(t *testing.T) {
+	build := func(seed string) []byte {
+		mb := richBook()
+		mb.CreatedDate = time.Now()
+		mb.UniqueID = rand.Uint32()
+		buf := bytes.NewBuffer(nil)
+		err := mb.Reproducible(seed).Realize().Write(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, seed := range []string{"", "urn:uuid:0b5e4d5c-1b5c-4a5e-8f5e-2f2b8a8c9d0e"} {
+		first := build(seed)
+		for i := 0; i < 5; i++ {
+			if !bytes.Equal(first, build(seed)) {
+				t.Fatalf("Output differs between builds with seed %q", seed)
+			}
+		}
+	}
+
+	for _, change := range []func(*mobi.Book){
+		func(mb *mobi.Book) { mb.Chapters[0].Title = "Changed" },
+		func(mb *mobi.Book) { mb.Chapters[0].PageSpread = mobi.PageSpreadLeft },
+		func(mb *mobi.Book) { mb.PublishedDate = mb.PublishedDate.AddDate(1, 0, 0) },
+		func(mb *mobi.Book) { mb.ASIN = "B000000001" },
+		func(mb *mobi.Book) { mb.FixedLayout = true },
+		func(mb *mobi.Book) { mb.RightToLeft = true },
+		func(mb *mobi.Book) { mb.Vertical = true },
+		func(mb *mobi.Book) { mb.StartReading = &mobi.StartLocation{Chapter: 1} },
+		func(mb *mobi.Book) { mb.ImageProfile = mobi.ProfileKindle },
+		func(mb *mobi.Book) { mb.CoverProfile = &mobi.ProfileKindleOasis },
+	} {
+		changed := richBook()
+		change(&changed)
+		assertEq(t, changed.Reproducible("").UniqueID != richBook().Reproducible("").UniqueID, true)
+	}
+	changed := richBook()
+	changed.Chapters[0].Title = "Changed"
+	assertEq(t, changed.Reproducible("a").UniqueID, richBook().Reproducible("a").UniqueID)
+}
+
+func richBook() mobi.Book {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	mb := testBook()
+	mb.Contributors = []string{"Translator"}
+	mb.Language = language.MustParse("x-klingon")
+	mb.PublishedDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mb.CSSFlows = []string{"p { margin: 0; }"}
+	mb.Images = []image.Image{img}
+	mb.CoverImage = img
+	mb.EmbedSpine = true
+	mb.Chapters = append(mb.Chapters, mobi.Chapter{
+		Title:  "Chapter 2",
+		Chunks: mobi.Chunks(`<p>Second</p>`, `<img src="kindle:embed:0001"/>`),
+	})
+	return mb
+}
+
+func TestFlows(t *testing.T) {
+	mb := testBook()
+	mb.CSSFlows = []string{"p { margin: 0; }"}
+	mb.Flows = []mobi.Flow{{MIME: "image/svg+xml", Content: `<svg xmlns="http://www.w3.org/2000/svg"/>`}}
+	assertEq(t, mb.FlowURI(0), "kindle:flow:0002?mime=image/svg+xml")
+
+	null, err := records.ReadNullRecord(writeRecord(mb.Realize().Records[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, null.MOBIHeader.Unknown3OrFDSTEntryCount, uint32(3))
+}
+
+func TestSkeletonOverride(t *testing.T) {
+	mb := testBook()
+	fail := errors.New("fail")
+	mb.Chapters[0].OverrideSkeleton(func(inv mobi.Inventory) (string, error) {
+		return "", fail
+	})
+	_, err := mb.TryRealize()
+	assertEq(t, errors.Is(err, fail), true)
+
+	mb.Chapters[0].OverrideSkeleton(func(inv mobi.Inventory) (string, error) {
+		s, err := mobi.DefaultSkeleton(inv)
+		return strings.Replace(s, "<head>", `<head><meta name="viewport" content="width=600, height=800"/>`, 1), err
+	})
+	_, err = mb.TryRealize()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateSanitize(t *testing.T) {
+	mb := testBook()
+	mb.CSSFlows = []string{"p { cursor: pointer; margin: 0 }"}
+	mb.Chapters[0].Chunks = mobi.Chunks(
+		`<p onclick="alert()">One&nbsp;<b>bold</p>`,
+		`<script>alert()</script><p style="transition: all 1s; color: red">Two<br></p>`,
+	)
+
+	err := mb.Validate()
+	errs, ok := err.(mobi.ValidationErrors)
+	assertEq(t, ok, true)
+	assertEq(t, len(errs), 2)
+	assertEq(t, errs[0].Chunk, 0)
+
+	sb, err := mb.Sanitize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sb.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, sb.Chapters[0].Chunks[0].Body, "<p>One\u00a0<b>bold</b></p>")
+	assertEq(t, sb.Chapters[0].Chunks[1].Body, `<p style="color: red">Two<br/></p>`)
+	assertEq(t, sb.CSSFlows[0], "p { margin: 0 }")
+	assertEq(t, mb.Chapters[0].Chunks[1].Body[:8], "<script>")
+
+	// Delimiters inside of strings and url() values are kept
+	css := `p { background: url(data:image/png;base64,iVBORw0KGgo=); cursor: pointer; content: "a;b}" }`
+	assertEq(t, xhtml.SanitizeCSS(css), `p { background: url(data:image/png;base64,iVBORw0KGgo=); content: "a;b}" }`)
+	decls := `background: url("a;b.png"); cursor: pointer; content: 'c;d'`
+	assertEq(t, xhtml.SanitizeDeclarations(decls), `background: url("a;b.png"); content: 'c;d'`)
+
+	// Content after removed elements with void children is kept
+	body, err := xhtml.SanitizeFragment(`<p>a</p><form><input type="text"><br></form><p>after form</p><p>more</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, body, "<p>a</p><p>after form</p><p>more</p>")
+	body, err = xhtml.SanitizeFragment(`<form><p>unclosed<input/></form><p>after</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, body, "<p>after</p>")
+}
+
+func TestSubChapters(t *testing.T) {
+	mb := testBook()
+	mb.Chapters[0].SubChapters = []mobi.Chapter{{
+		Title:  "Section 1.1",
+		Chunks: mobi.Chunks(`<p>Nested</p>`),
+		SubChapters: []mobi.Chapter{{
+			Title:  "Section 1.1.1",
+			Chunks: mobi.Chunks(`<p>Deep<b></p>`),
+		}},
+	}}
+
+	// Chapters are numbered in depth-first order
+	err := mb.Validate()
+	errs, ok := err.(mobi.ValidationErrors)
+	assertEq(t, ok, true)
+	assertEq(t, errs[0].Chapter, 2)
+
+	sb, err := mb.Sanitize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, sb.Chapters[0].SubChapters[0].SubChapters[0].Chunks[0].Body, "<p>Deep<b></b></p>")
+	db, err := sb.TryRealize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	null, err := records.ReadNullRecord(writeRecord(db.Records[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Books with sub-chapters use the hierarchical NCX table
+	rec := writeRecord(db.Records[null.MOBIHeader.INDXRecordOffset])
+	h := types.INDXHeader{}
+	err = binary.Read(bytes.NewReader(rec), pdb.Endian, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagx := types.TAGXHeader{}
+	err = binary.Read(bytes.NewReader(rec[h.TAGXOffset:]), pdb.Endian, &tagx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, h.IndexEntryCount, uint32(3))
+	assertEq(t, int(tagx.HeaderLength), types.TAGXHeaderLength+4*len(types.TAGXTableNCX))
+}
+
+func TestMarkdown(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	buf := bytes.NewBuffer(nil)
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"book/one.md": {Data: []byte("---\ntitle: Markdown Book\nauthors: [One, \"Two\"]\nlanguage: de\n---\n" +
+			"# First\n\nSome *text*.\n\n## Section\n\n![Figure](img/fig.png)\n\n```go\nfunc() {}\n```\n")},
+		"book/two.md":      {Data: []byte("Preface\n\n# Second\n\n- a\n- b\n\n![Again](img/fig.png)\n")},
+		"book/img/fig.png": {Data: buf.Bytes()},
+	}
+
+	mb, err := markdown.Convert(fsys, "book/one.md", "book/two.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, mb.Title, "Markdown Book")
+	assertEq(t, mb.UniqueID, uint32(mb.CreatedDate.UnixNano()))
+	assertEq(t, strings.Join(mb.Authors, ","), "One,Two")
+	assertEq(t, len(mb.Chapters), 3)
+	assertEq(t, mb.Chapters[0].SubChapters[0].Title, "Section")
+	assertEq(t, mb.Chapters[1].Title, "two")
+	assertEq(t, len(mb.Images), 1)
+	assertEq(t, strings.Contains(mb.Chapters[0].SubChapters[0].Chunks[0].Body, mb.ImageURI(0)), true)
+	assertEq(t, mb.CSSFlows[0], markdown.Stylesheet)
+
+	err = mb.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mb.TryRealize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Aliases are applied in a fixed order
+	fsys["book/alias.md"] = &fstest.MapFile{Data: []byte("---\nauthors: [A]\nauthor: B\nlang: en\nlanguage: fr\n---\n# Alias\n")}
+	for i := 0; i < 10; i++ {
+		mb, err = markdown.Convert(fsys, "book/alias.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, strings.Join(mb.Authors, ","), "A")
+		assertEq(t, mb.Language, language.French)
+	}
+}
+
+func TestPalmDOC(t *testing.T) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog.\n\xe4\x01 ", 300)
+	doc := palmdoc.Document{
+		Title:     "Test Text",
+		Date:      time.Unix(0, 0).UTC(),
+		Text:      text,
+		Position:  100,
+		Bookmarks: []palmdoc.Bookmark{{Name: "Middle", Offset: len(text) / 2}},
+	}
+	db := roundTrip(t, doc.Realize())
+	assertEq(t, db.Type, palmdoc.Type)
+	assertEq(t, len(writeRecord(db.Records[1])) < palmdoc.RecordSize/2, true)
+
+	rdoc, err := palmdoc.Read(*db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, rdoc.Text, doc.Text)
+	assertEq(t, rdoc.Position, doc.Position)
+	assertEq(t, rdoc.Bookmarks[0], doc.Bookmarks[0])
+
+	db.AddRecord(pdb.RawRecord("not a bookmark"))
+	rdoc, err = palmdoc.Read(*db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(rdoc.Bookmarks), 1)
+
+	_, err = palmdoc.Read(*roundTrip(t, testBook().Realize()))
+	assertEq(t, err, palmdoc.ErrNotPalmDOC)
+}
+
+func TestExportEPUB(t *testing.T) {
+	mb := richBook()
+	mb.Chapters[1].SubChapters = []mobi.Chapter{{
+		Title:  "Section 2.1",
+		Chunks: mobi.Chunks(`<p id="sub">Nested</p>`),
+	}}
+	buf := bytes.NewBuffer(nil)
+	err := epub.Export(buf, *roundTrip(t, mb.Realize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, z.File[0].Name, "mimetype")
+	files := make(map[string]string)
+	for _, f := range z.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+		if strings.HasSuffix(f.Name, ".xhtml") || strings.HasSuffix(f.Name, ".opf") {
+			err := xhtml.Check(string(data))
+			if err != nil {
+				t.Fatalf("%v: %v", f.Name, err)
+			}
+		}
+	}
+
+	assertEq(t, len(files), 10)
+	assertEq(t, strings.Contains(files["OEBPS/content.opf"], "<dc:title>Test Book</dc:title>"), true)
+	assertEq(t, strings.Contains(files["OEBPS/content.opf"], `properties="cover-image"`), true)
+	assertEq(t, strings.Contains(files["OEBPS/nav.xhtml"], "Chapter 2</a><ol><li>"), true)
+	assertEq(t, strings.Contains(files["OEBPS/text/part0001.xhtml"], `src="../images/image0001.jpg"`), true)
+	assertEq(t, strings.Contains(files["OEBPS/text/part0002.xhtml"], "Nested"), true)
+	assertEq(t, files["OEBPS/styles/flow0001.css"], mb.CSSFlows[0])
+	assertEq(t, strings.Contains(files["OEBPS/content.opf"], `href="images/image0001.jpg" media-type="image/jpeg"`), true)
+	assertEq(t, strings.Contains(files["OEBPS/content.opf"], `href="styles/flow0001.css" media-type="text/css"`), true)
+}
+
+func TestExportEPUBBitmap(t *testing.T) {
+	db := roundTrip(t, richBook().Realize())
+	null := mustReadNull(t, db)
+	db.Records[null.MOBIHeader.FirstImageIndex] = pdb.RawRecord("BM" + strings.Repeat("\x00", 64))
+	buf := bytes.NewBuffer(nil)
+	err := epub.Export(buf, *db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := z.Open("OEBPS/content.opf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opf, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, strings.Contains(string(opf), `href="images/image0001.bmp" media-type="image/bmp"`), true)
+}
+
+func TestReadIndex(t *testing.T) {
+	mb := richBook()
+	mb.Chapters[1].SubChapters = []mobi.Chapter{{
+		Title:  "Section 2.1",
+		Chunks: mobi.Chunks(`<p>Nested</p>`),
+	}}
+	recs := make([][]byte, 0)
+	for _, rec := range mb.Realize().Records {
+		recs = append(recs, writeRecord(rec))
+	}
+	null, err := records.ReadNullRecord(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncx, err := records.ReadIndex(recs, int(null.MOBIHeader.INDXRecordOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, 0)
+	for _, e := range ncx.Entries {
+		title, _ := ncx.String(e.Get(types.TAGXTagEntryNameOffset)[0])
+		titles = append(titles, title)
+	}
+	assertEq(t, strings.Join(titles, ", "), "Chapter 1, Chapter 2, Section 2.1")
+	assertEq(t, ncx.Entries[2].Get(types.TAGXTagEntryParent)[0], 1)
+	assertEq(t, ncx.Entries[1].Get(types.TAGXTagEntryChild1)[0], 2)
+
+	skels, err := records.ReadIndex(recs, int(null.MOBIHeader.SkeletonIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(skels.Entries), 3)
+	assertEq(t, skels.Entries[1].Get(types.TAGXTagSkeletonChunkCount)[0], 2)
+
+	chunks, err := records.ReadIndex(recs, int(null.MOBIHeader.ChunkIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(chunks.Entries), 4)
+	assertEq(t, chunks.Entries[3].Get(types.TAGXTagChunkFileNumber)[0], 2)
+
+	_, err = records.ReadIndex(recs, 1)
+	assertEq(t, err != nil, true)
+}
+
+func TestReadIndexORDT(t *testing.T) {
+	b := records.NewIndexBuilder(types.TAGXTableSkeleton)
+	b.Add("\x00\x01", map[types.TAGXTag][]int{
+		types.TAGXTagSkeletonChunkCount: {1},
+	})
+	recs := make([][]byte, 0)
+	for _, rec := range b.Records() {
+		recs = append(recs, writeRecord(rec))
+	}
+
+	// Labels are indices into the ORDT2 table, which follows an ORDT1
+	// table with one byte per entry
+	header := recs[0]
+	ordt1 := len(header)
+	header = append(header, "ORDT\x00\x01"...)
+	ordt2 := len(header)
+	header = append(header, "ORDT\x30\x42\x30\x44"...)
+	for i, v := range []int{1, 2, ordt1, ordt2} {
+		pdb.Endian.PutUint32(header[0xA4+4*i:], uint32(v))
+	}
+	recs[0] = header
+
+	index, err := records.ReadIndex(recs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, index.Entries[0].Label, "\u3042\u3044")
+}
+
+func TestIndexBuilder(t *testing.T) {
+	b := records.NewIndexBuilder(types.TAGXTablePeriodical)
+	for i := 0; i < 10000; i++ {
+		b.Add(fmt.Sprintf("%05d", i), map[types.TAGXTag][]int{
+			types.TAGXTagEntryPosition:   {i * 1000},
+			types.TAGXTagEntryNameOffset: {b.AddString(fmt.Sprint(i % 100))},
+			types.TAGXTagPeriodicalImage: {i % 7},
+		})
+	}
+	recs := make([][]byte, 0)
+	for _, rec := range b.Records() {
+		recs = append(recs, writeRecord(rec))
+		assertEq(t, len(recs[len(recs)-1]) <= records.MaxIndexRecordSize, true)
+	}
+	assertEq(t, len(recs) > 3, true)
+
+	index, err := records.ReadIndex(recs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, int(index.Header.IndexRecordCount), len(recs)-2)
+	assertEq(t, len(index.Entries), 10000)
+	last := index.Entries[9999]
+	name, _ := index.String(last.Get(types.TAGXTagEntryNameOffset)[0])
+	assertEq(t, last.Label, "09999")
+	assertEq(t, last.Get(types.TAGXTagEntryPosition)[0], 9999000)
+	assertEq(t, last.Get(types.TAGXTagPeriodicalImage)[0], 9999%7)
+	assertEq(t, name, "99")
+
+	// Counts that fill a multi-bit mask are prefixed with their size
+	b = records.NewIndexBuilder(types.TAGXTableSkeleton)
+	b.Add("SKEL", map[types.TAGXTag][]int{
+		types.TAGXTagSkeletonGeometry: {1, 2, 300, 4, 5, 60000},
+	})
+	recs = recs[:0]
+	for _, rec := range b.Records() {
+		recs = append(recs, writeRecord(rec))
+	}
+	index, err = records.ReadIndex(recs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, fmt.Sprint(index.Entries[0].Get(types.TAGXTagSkeletonGeometry)), "[1 2 300 4 5 60000]")
+}
+
+func TestLargeIndex(t *testing.T) {
+	mb := testBook()
+	mb.Chapters = nil
+	for i := 0; i < 4000; i++ {
+		mb.Chapters = append(mb.Chapters, mobi.Chapter{
+			Title:  fmt.Sprintf("Chapter %v with a rather long title", i),
+			Chunks: mobi.Chunks(fmt.Sprintf("<p>Chapter %v</p>", i)),
+		})
+	}
+	recs := make([][]byte, 0)
+	for _, rec := range mb.Realize().Records {
+		recs = append(recs, writeRecord(rec))
+	}
+	null, err := records.ReadNullRecord(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ncx, err := records.ReadIndex(recs, int(null.MOBIHeader.INDXRecordOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, ncx.Header.IndexRecordCount > 1, true)
+	assertEq(t, ncx.Header.CNCXCount > 1, true)
+	assertEq(t, len(ncx.Entries), 4000)
+	title, _ := ncx.String(ncx.Entries[3999].Get(types.TAGXTagEntryNameOffset)[0])
+	assertEq(t, title, mb.Chapters[3999].Title)
+
+	chunks, err := records.ReadIndex(recs, int(null.MOBIHeader.ChunkIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, chunks.Header.IndexRecordCount > 1, true)
+	assertEq(t, len(chunks.Entries), 4000)
+}
+
+func TestStartReading(t *testing.T) {
+	mb := richBook()
+	mb.Chapters[1].Chunks = mobi.Chunks(`<p>Preface</p>`, `<p>Foreword</p><h1 id="start">Begin</h1>`)
+	mb.StartReading = &mobi.StartLocation{Chapter: 1, Anchor: "start"}
+	recs := make([][]byte, 0)
+	for _, rec := range mb.Realize().Records {
+		recs = append(recs, writeRecord(rec))
+	}
+	null, err := records.ReadNullRecord(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := ""
+	_, err = mb.PageMap(func(html string) []int {
+		text = html
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, ok := null.EXTHSection.Int(types.EXTHStartReading)
+	assertEq(t, ok, true)
+	assertEq(t, strings.HasPrefix(text[pos:], `<h1 id="start">`), true)
+
+	guide, err := records.ReadIndex(recs, int(null.MOBIHeader.GuideIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, guide.Entries[0].Label, "text")
+	assertEq(t, fmt.Sprint(guide.Entries[0].Get(types.TAGXTagGuidePosFid)), "[2 15]")
+
+	mb.StartReading.Anchor = "missing"
+	_, err = mb.TryRealize()
+	assertEq(t, errors.Is(err, mobi.ErrInvalidStartLocation), true)
+}
+
+func TestSample(t *testing.T) {
+	mb := richBook()
+	mb.Images = append(mb.Images, image.NewGray(image.Rect(0, 0, 8, 8)))
+	mb.Chapters[0].Chunks = mobi.Chunks(`<img src="kindle:embed:0002"/>`)
+	mb.Chapters = append(mb.Chapters, mobi.Chapter{
+		Title:  "Chapter 3",
+		Chunks: mobi.Chunks(`<p>Third</p>`),
+	})
+	buy := mobi.Chapter{Title: "Buy", Chunks: mobi.Chunks(`<p>Buy the full book</p>`)}
+
+	sample, err := mb.Sample(mobi.SampleOptions{Chapters: 1, BuyChapter: &buy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(sample.Chapters), 2)
+	assertEq(t, len(sample.Images), 1)
+	assertEq(t, sample.Chapters[0].Chunks[0].Body, `<img src="kindle:embed:0001"/>`)
+	assertEq(t, mb.Chapters[0].Chunks[0].Body, `<img src="kindle:embed:0002"/>`)
+
+	null, err := records.ReadNullRecord(writeRecord(sample.Realize().Records[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := null.EXTHSection.Int(types.EXTHSample)
+	assertEq(t, value, 1)
+	cover, _ := null.EXTHSection.Int(types.EXTHCoverOffset)
+	assertEq(t, cover, 1)
+
+	sample, err = mb.Sample(mobi.SampleOptions{Percent: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(sample.Chapters), 2)
+	assertEq(t, len(sample.Chapters[1].Chunks), 1)
+
+	_, err = mb.Sample(mobi.SampleOptions{})
+	assertEq(t, errors.Is(err, mobi.ErrInvalidSample), true)
+}
+
+func TestMerge(t *testing.T) {
+	x := image.NewGray(image.Rect(0, 0, 8, 8))
+	y := image.NewGray(image.Rect(0, 0, 16, 16))
+	first := testBook()
+	first.Title = "First"
+	first.CSSFlows = []string{"p { margin: 0; }"}
+	first.Images = []image.Image{x}
+	second := testBook()
+	second.Title = "Second"
+	second.Authors = []string{"Sueton", "Plutarch"}
+	second.CSSFlows = []string{"h1 { color: red; }", "p { margin: 0; }"}
+	second.Images = []image.Image{y, x}
+	second.Chapters[0].Chunks = mobi.Chunks(
+		`<img src="kindle:embed:0001"/><img src="kindle:embed:0002?mime=image/jpeg"/>`,
+		`<a href="kindle:flow:0001?mime=text/css">Style</a>`,
+	)
+
+	mb := mobi.Merge("Omnibus", first, second)
+	assertEq(t, mb.Title, "Omnibus")
+	assertEq(t, strings.Join(mb.Authors, ", "), "Sueton, Plutarch")
+	assertEq(t, len(mb.Images), 2)
+	assertEq(t, len(mb.CSSFlows), 2)
+	assertEq(t, len(mb.Chapters), 2)
+	assertEq(t, mb.Chapters[1].Title, "Second")
+	chunks := mb.Chapters[1].SubChapters[0].Chunks
+	assertEq(t, chunks[0].Body, `<img src="kindle:embed:0002"/><img src="kindle:embed:0001?mime=image/jpeg"/>`)
+	assertEq(t, chunks[1].Body, `<a href="kindle:flow:0002?mime=text/css">Style</a>`)
+
+	// Chapters only link the stylesheets of their own book
+	text := ""
+	_, err := mb.PageMap(func(html string) []int {
+		text = html
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, strings.Count(text, "kindle:flow:0001?mime=text/css"), 2)
+	assertEq(t, strings.Count(text, `href="kindle:flow:0002?mime=text/css"`), 2)
+
+	// The cover of the first book remains the cover of the result,
+	// while covers of other books become regular images
+	cover := image.NewGray(image.Rect(0, 0, 24, 24))
+	first.CoverImage = cover
+	first.ThumbImage = image.NewGray(image.Rect(0, 0, 4, 4))
+	first.Chapters[0].Chunks = mobi.Chunks(`<img src="kindle:embed:0002"/><img src="kindle:embed:0003"/>`)
+	second.CoverImage = image.NewGray(image.Rect(0, 0, 32, 32))
+	second.Chapters[0].Chunks = mobi.Chunks(`<img src="kindle:embed:0003"/>`)
+	mb = mobi.Merge("Omnibus", first, second)
+	assertEq(t, len(mb.Images), 3)
+	assertEq(t, mb.CoverImage, image.Image(cover))
+	assertEq(t, mb.Chapters[0].SubChapters[0].Chunks[0].Body, `<img src="kindle:embed:0004"/><img src="kindle:embed:0005"/>`)
+	assertEq(t, mb.Chapters[1].SubChapters[0].Chunks[0].Body, `<img src="kindle:embed:0003"/>`)
+}
+
+func TestEditMetadata(t *testing.T) {
+	db := roundTrip(t, richBook().Realize())
+	e, err := edit.Open(*db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, e.Title(), "Test Book")
+	e.SetTitle("A considerably longer title than before")
+	e.SetStrings(types.EXTHAuthor, "Gaius Suetonius Tranquillus", "Plutarch")
+	e.SetStrings(types.EXTHASIN, "B000000000")
+	e.SetLanguage(language.German)
+	e.Remove(types.EXTHContributor)
+	edited, err := e.Database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited = *roundTrip(t, edited)
+
+	data := writeRecord(edited.Records[0])
+	assertEq(t, len(data)%4, 0)
+	null, err := records.ReadNullRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, null.FullName, "A considerably longer title than before")
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHAuthor), ", "), "Gaius Suetonius Tranquillus, Plutarch")
+	assertEq(t, strings.Join(null.EXTHSection.Strings(types.EXTHASIN), ", "), "B000000000")
+	assertEq(t, len(null.EXTHSection.Strings(types.EXTHContributor)), 0)
+	assertEq(t, null.EXTHSection.Strings(types.EXTHLanguage)[0], "de")
+	assertEq(t, null.MOBIHeader.Locale, mobi.Locale(language.German))
+	assertEq(t, null.MOBIHeader.SkeletonIndex, mustReadNull(t, db).MOBIHeader.SkeletonIndex)
+
+	assertEq(t, len(edited.Records), len(db.Records))
+	for i := 1; i < len(db.Records); i++ {
+		assertEq(t, bytes.Equal(writeRecord(edited.Records[i]), writeRecord(db.Records[i])), true)
+	}
+}
+
+func mustReadNull(t *testing.T, db *pdb.Database) records.NullRecord {
+	null, err := records.ReadNullRecord(writeRecord(db.Records[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return null
+}
+
+func TestSetCover(t *testing.T) {
+	cover := image.NewRGBA(image.Rect(0, 0, 60, 80))
+	rand.New(rand.NewSource(2)).Read(cover.Pix)
+
+	// Add a cover to a book without images
+	db := roundTrip(t, testBook().Realize())
+	e, err := edit.Open(*db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.SetCover(cover, mobi.ImageProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err := e.Database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(edited.Records), len(db.Records)+1)
+	null := mustReadNull(t, &edited)
+	offset, _ := null.EXTHSection.Int(types.EXTHCoverOffset)
+	count, _ := null.EXTHSection.Int(types.EXTHKF8CountResources)
+	assertEq(t, offset, 0)
+	assertEq(t, count, 1)
+	assertEq(t, null.EXTHSection.Strings(types.EXTHKF8CoverURI)[0], "kindle:embed:0001")
+	assertEq(t, bytes.HasPrefix(writeRecord(edited.Records[null.MOBIHeader.FirstImageIndex]), []byte("\xff\xd8")), true)
+	assertEq(t, writeRecord(edited.Records[null.MOBIHeader.LastContentRecordNumberOrFDSTNumberLSB])[0], byte('F'))
+	assertEq(t, writeRecord(edited.Records[null.MOBIHeader.FCISRecordNumber])[0], byte('F'))
+
+	buf := bytes.NewBuffer(nil)
+	err = epub.Export(buf, *roundTrip(t, edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the cover of a book with images
+	db = roundTrip(t, richBook().Realize())
+	e, err = edit.Open(*db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.SetCover(cover, mobi.ImageProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err = e.Database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(edited.Records), len(db.Records))
+	null = mustReadNull(t, &edited)
+	first := int(null.MOBIHeader.FirstImageIndex)
+	assertEq(t, bytes.Equal(writeRecord(edited.Records[first]), writeRecord(db.Records[first])), true)
+	assertEq(t, bytes.Equal(writeRecord(edited.Records[first+1]), writeRecord(db.Records[first+1])), false)
+}
+
+func TestLocale(t *testing.T) {
+	for tag, code := range map[string]uint32{
+		"en":      0x009,
+		"en-GB":   0x809,
+		"pt-BR":   0x416,
+		"pt-PT":   0x816,
+		"zh-Hans": 0x804,
+		"zh-Hant": 0x404,
+		"nn":      0x814,
+		"und":     0x000,
+	} {
+		assertEq(t, mobi.Locale(language.MustParse(tag)), code)
+	}
+
+	mb := testBook()
+	mb.Language = language.MustParse("pt-BR")
+	mb.InputLanguage = language.MustParse("en-GB")
+	mb.OutputLanguage = language.MustParse("pt-BR")
+	db := mb.Realize()
+	null := mustReadNull(t, &db)
+	assertEq(t, null.MOBIHeader.Locale, uint32(0x416))
+	assertEq(t, null.MOBIHeader.InputLanguage, uint32(0x809))
+	assertEq(t, null.MOBIHeader.OutputLanguage, uint32(0x416))
+	assertEq(t, null.EXTHSection.Strings(types.EXTHLanguage)[0], "pt-BR")
+	assertEq(t, null.EXTHSection.Strings(types.EXTHDictLangInput)[0], "en-GB")
+	assertEq(t, null.EXTHSection.Strings(types.EXTHDictLangOutput)[0], "pt-BR")
+}
+
+func TestEmbedSpine(t *testing.T) {
+	mb := testBook()
+	mb.EmbedSpine = true
+	mb.RightToLeft = true
+	mb.Images = []image.Image{image.NewGray(image.Rect(0, 0, 8, 8))}
+	mb.Chapters[0].PageSpread = mobi.PageSpreadRight
+	mb.Chapters[0].SubChapters = []mobi.Chapter{
+		{Title: "Left", Chunks: mobi.Chunks(`<p>Left</p>`), PageSpread: mobi.PageSpreadLeft},
+		{Title: "Empty", PageSpread: mobi.PageSpreadCenter},
+		{Title: "Auto", Chunks: mobi.Chunks(`<p>Auto</p>`)},
+	}
+	db := mb.Realize()
+	null := mustReadNull(t, &db)
+	count, _ := null.EXTHSection.Int(types.EXTHKF8CountResources)
+	assertEq(t, count, 2)
+
+	resc := writeRecord(db.Records[int(null.MOBIHeader.FirstImageIndex)+1])
+	assertEq(t, string(resc[:4]), "RESC")
+	spine := string(resc[bytes.Index(resc, []byte("<spine")):bytes.Index(resc, []byte("</spine>"))])
+	assertEq(t, spine, `<spine page-progression-direction="rtl" toc="ncx">`+
+		`<itemref idref="part0000" skelid="0" properties="page-spread-right"/>`+
+		`<itemref idref="part0001" skelid="1" properties="page-spread-left"/>`+
+		`<itemref idref="part0002" skelid="2"/>`)
+}
+
+func TestPeriodical(t *testing.T) {
+	p := mobi.Periodical{
+		Book:     testBook(),
+		Magazine: true,
+		Masthead: image.NewGray(image.Rect(0, 0, 60, 10)),
+		Sections: []mobi.Section{{
+			Title: "News",
+			Articles: []mobi.Article{
+				{Title: "First", Author: "Reporter", Chunks: mobi.Chunks(`<p>First</p>`)},
+				{Title: "Second", Description: "More news", Chunks: mobi.Chunks(`<p>Second</p>`)},
+			},
+		}, {
+			Title:    "Sports",
+			Articles: []mobi.Article{{Title: "Third", Chunks: mobi.Chunks(`<p>Third</p>`)}},
+		}},
+	}
+	p.Images = []image.Image{image.NewGray(image.Rect(0, 0, 8, 8))}
+	recs := make([][]byte, 0)
+	for _, rec := range p.Realize().Records {
+		recs = append(recs, writeRecord(rec))
+	}
+	null, err := records.ReadNullRecord(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, null.MOBIHeader.MOBIType, uint32(0x103))
+
+	ncx, err := records.ReadIndex(recs, int(null.MOBIHeader.INDXRecordOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(ncx.Entries), 6)
+	get := func(i int, tag types.TAGXTag) string {
+		return fmt.Sprint(ncx.Entries[i].Get(tag))
+	}
+	str := func(i int, tag types.TAGXTag) string {
+		s, _ := ncx.String(ncx.Entries[i].Get(tag)[0])
+		return s
+	}
+
+	// Periodical, sections and articles in order of depth
+	assertEq(t, str(0, types.TAGXTagPeriodicalClass), "periodical")
+	assertEq(t, get(0, types.TAGXTagPeriodicalImage), "[1]")
+	assertEq(t, get(0, types.TAGXTagPeriodicalChild1)+get(0, types.TAGXTagPeriodicalChildN), "[1][2]")
+	assertEq(t, str(1, types.TAGXTagEntryNameOffset), "News")
+	assertEq(t, get(1, types.TAGXTagPeriodicalParent), "[0]")
+	assertEq(t, get(1, types.TAGXTagPeriodicalChild1)+get(1, types.TAGXTagPeriodicalChildN), "[3][4]")
+	assertEq(t, get(2, types.TAGXTagPeriodicalChild1)+get(2, types.TAGXTagPeriodicalChildN), "[5][5]")
+	assertEq(t, str(3, types.TAGXTagPeriodicalClass), "article")
+	assertEq(t, str(3, types.TAGXTagPeriodicalAuthor), "Reporter")
+	assertEq(t, str(4, types.TAGXTagPeriodicalDesc), "More news")
+	assertEq(t, get(5, types.TAGXTagPeriodicalParent), "[2]")
+	assertEq(t, get(5, types.TAGXTagEntryDepthLevel), "[2]")
+
+	// Reproducible periodicals keep their sections
+	rp := p.Reproducible("")
+	assertEq(t, len(rp.Sections), 2)
+	changed := p
+	changed.Sections = append([]mobi.Section{}, p.Sections...)
+	changed.Sections[1].Articles = []mobi.Article{{Title: "Fourth", Chunks: mobi.Chunks(`<p>Fourth</p>`)}}
+	assertEq(t, changed.Reproducible("").UniqueID != rp.UniqueID, true)
+	assertEq(t, p.Reproducible("").UniqueID, rp.UniqueID)
+
+	changed.Sections[1].Articles = nil
+	_, err = changed.TryRealize()
+	assertEq(t, errors.Is(err, mobi.ErrInvalidPeriodical), true)
+	changed.Sections = nil
+	_, err = changed.TryRealize()
+	assertEq(t, errors.Is(err, mobi.ErrInvalidPeriodical), true)
+}
+
+func TestChunkGeometry(t *testing.T) {
+	mb := testBook()
+	mb.Chapters[0].Chunks = mobi.Chunks(`<p>One</p>`, `<p>Two</p>`, `<p>Three</p>`)
+	mb.Chapters = append(mb.Chapters, mobi.Chapter{
+		Title:  "Chapter 2",
+		Chunks: mobi.Chunks(`<p>Four</p>`),
+	})
+	recs := make([][]byte, 0)
+	for _, rec := range mb.Realize().Records {
+		recs = append(recs, writeRecord(rec))
+	}
+	null, err := records.ReadNullRecord(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := ""
+	_, err = mb.PageMap(func(html string) []int {
+		text = html
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skels, err := records.ReadIndex(recs, int(null.MOBIHeader.SkeletonIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := records.ReadIndex(recs, int(null.MOBIHeader.ChunkIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, len(skels.Entries), 2)
+	assertEq(t, fmt.Sprint(skels.Entries[0].Get(types.TAGXTagSkeletonChunkCount)), "[3 3]")
+	assertEq(t, fmt.Sprint(skels.Entries[1].Get(types.TAGXTagSkeletonChunkCount)), "[1 1]")
+
+	// All chunks of a chapter are inserted before the end of the body
+	// of one shared skeleton, which is followed by the chunks
+	bodies := make([]string, 0)
+	files := make([]int, 0)
+	for _, e := range chunks.Entries {
+		file := e.Get(types.TAGXTagChunkFileNumber)[0]
+		geometry := skels.Entries[file].Get(types.TAGXTagSkeletonGeometry)
+		assertEq(t, len(geometry), 4)
+		assertEq(t, fmt.Sprint(geometry[2:]), fmt.Sprint(geometry[:2]))
+		start, length := geometry[0], geometry[1]
+		skeleton := text[start : start+length]
+		assertEq(t, strings.Contains(skeleton, "<p>"), false)
+
+		chunk := e.Get(types.TAGXTagChunkGeometry)
+		insertPos := start + strings.LastIndex(skeleton, "</body>") + chunk[0]
+		assertEq(t, e.Label, fmt.Sprintf("%010d", insertPos))
+		bodies = append(bodies, text[start+length+chunk[0]:start+length+chunk[0]+chunk[1]])
+		files = append(files, file)
+	}
+	assertEq(t, strings.Join(bodies, ""), "<p>One</p><p>Two</p><p>Three</p><p>Four</p>")
+	assertEq(t, fmt.Sprint(files), "[0 0 0 1]")
+	first := skels.Entries[0].Get(types.TAGXTagSkeletonGeometry)
+	second := skels.Entries[1].Get(types.TAGXTagSkeletonGeometry)
+	assertEq(t, second[0], first[0]+first[1]+len(bodies[0]+bodies[1]+bodies[2]))
+}
@@ -0,0 +1,39 @@
+package mobi
+
+import (
+	"fmt"
+
+	"github.com/leotaku/mobi/apnx"
+)
+
+// PageMap computes the page map that should be written to an APNX
+// file alongside the generated book in order for Kindle readers to
+// display real page numbers.
+//
+// The paginate function is passed the KF8 HTML text of the book and
+// is expected to return the start offsets of all pages, for example
+// by calling apnx.PagesFromMarkers or apnx.PagesFromLength.
+func (m Book) PageMap(paginate func(text string) []int) (apnx.PageMap, error) {
+	html, _, _, _, err := chaptersToText(m)
+	if err != nil {
+		return apnx.PageMap{}, err
+	}
+
+	return apnx.PageMap{
+		GUID:    fmt.Sprintf("%08x", m.UniqueID),
+		ASIN:    m.asin(),
+		CDEType: m.cdeType(),
+		ACR:     palmName(m.Title),
+		Pages:   paginate(html),
+	}, nil
+}
+
+// palmName returns the name as it is stored in the Palm database
+// header.
+func palmName(name string) string {
+	if len(name) > 31 {
+		return name[:31]
+	}
+
+	return name
+}
@@ -0,0 +1,131 @@
+package palmdoc
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrCorruptData is returned when compressed data cannot be decoded.
+var ErrCorruptData = errors.New("palmdoc: corrupt compressed data")
+
+const (
+	maxDistance   = 2047
+	minLength     = 3
+	maxLength     = 10
+	maxCandidates = 64
+)
+
+// Compress compresses data using the LZ77 variant of the PalmDOC
+// format.  Text records are compressed individually, so data should
+// not be larger than one record.
+func Compress(data []byte) []byte {
+	out := bytes.NewBuffer(nil)
+	head := make(map[[minLength]byte]int)
+	prev := make([]int, len(data))
+	insert := func(i int) {
+		if i+minLength <= len(data) {
+			key := [minLength]byte{data[i], data[i+1], data[i+2]}
+			if p, ok := head[key]; ok {
+				prev[i] = p
+			} else {
+				prev[i] = -1
+			}
+			head[key] = i
+		}
+	}
+
+	for i := 0; i < len(data); {
+		dist, length := longestMatch(data, i, head, prev)
+		switch c := data[i]; {
+		case length >= minLength:
+			out.WriteByte(byte(0x80 | dist>>5))
+			out.WriteByte(byte(dist<<3 | (length - minLength)))
+		case c == ' ' && i+1 < len(data) && data[i+1] >= 0x40 && data[i+1] <= 0x7F:
+			out.WriteByte(data[i+1] ^ 0x80)
+			length = 2
+		case !needsEscape(c):
+			out.WriteByte(c)
+			length = 1
+		default:
+			length = 1
+			for length < 8 && i+length < len(data) && needsEscape(data[i+length]) {
+				length++
+			}
+			out.WriteByte(byte(length))
+			out.Write(data[i : i+length])
+		}
+		for end := i + length; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// longestMatch finds the longest earlier occurrence of the bytes at
+// position i within the window of the compression format.
+func longestMatch(data []byte, i int, head map[[minLength]byte]int, prev []int) (int, int) {
+	if i+minLength > len(data) {
+		return 0, 0
+	}
+
+	bestDist, bestLength := 0, 0
+	p, ok := head[[minLength]byte{data[i], data[i+1], data[i+2]}]
+	for n := 0; ok && p >= 0 && i-p <= maxDistance && n < maxCandidates; n++ {
+		length := 0
+		for length < maxLength && i+length < len(data) && p+length < i && data[p+length] == data[i+length] {
+			length++
+		}
+		if length > bestLength {
+			bestDist, bestLength = i-p, length
+		}
+		if bestLength == maxLength {
+			break
+		}
+		p = prev[p]
+	}
+
+	return bestDist, bestLength
+}
+
+func needsEscape(c byte) bool {
+	return c >= 0x01 && c <= 0x08 || c >= 0x80
+}
+
+// Decompress decompresses data that has been compressed using the
+// LZ77 variant of the PalmDOC format.
+func Decompress(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)*2)
+	for i := 0; i < len(data); {
+		c := data[i]
+		i++
+		switch {
+		case c >= 0x01 && c <= 0x08:
+			if i+int(c) > len(data) {
+				return nil, ErrCorruptData
+			}
+			out = append(out, data[i:i+int(c)]...)
+			i += int(c)
+		case c < 0x80:
+			out = append(out, c)
+		case c >= 0xC0:
+			out = append(out, ' ', c^0x80)
+		default:
+			if i >= len(data) {
+				return nil, ErrCorruptData
+			}
+			x := int(c)<<8 | int(data[i])
+			i++
+			dist := (x & 0x3FFF) >> 3
+			length := (x & 0x07) + minLength
+			if dist == 0 || dist > len(out) {
+				return nil, ErrCorruptData
+			}
+			for n := 0; n < length; n++ {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,203 @@
+// Package palmdoc implements reading and writing classic PalmDOC
+// databases, which store plain text with optional bookmarks.
+//
+// PalmDOC databases are identified by the "TEXt" type and "REAd"
+// creator.  The text is stored as raw bytes, which for most classic
+// documents are encoded in Windows-1252.
+package palmdoc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/leotaku/mobi/pdb"
+	t "github.com/leotaku/mobi/types"
+)
+
+const (
+	Type    = "TEXt"
+	Creator = "REAd"
+)
+
+// RecordSize is the maximum uncompressed size of a text record.
+const RecordSize = 4096
+
+const (
+	compressionNone    uint16 = 1
+	compressionPalmDOC uint16 = 2
+)
+
+var (
+	// ErrNotPalmDOC is returned when a database is not a PalmDOC database.
+	ErrNotPalmDOC = errors.New("palmdoc: not a PalmDOC database")
+	// ErrUnsupportedCompression is returned when the text of a
+	// database is compressed using an unknown scheme.
+	ErrUnsupportedCompression = errors.New("palmdoc: unsupported compression")
+)
+
+// Document represents the content of a PalmDOC database.
+//
+// Position is the offset in Text at which reading is resumed.  Text is
+// compressed unless Uncompressed is set.
+type Document struct {
+	Title        string
+	Date         time.Time
+	Text         string
+	Position     int
+	Bookmarks    []Bookmark
+	Uncompressed bool
+}
+
+// Bookmark represents a named offset in the text of a Document.
+//
+// Names are truncated to 15 bytes when the document is written.
+type Bookmark struct {
+	Name   string
+	Offset int
+}
+
+// Realize converts the document to a PalmDB database.
+func (d Document) Realize() pdb.Database {
+	db := pdb.NewDatabase(d.Title, d.Date)
+	db.Type = Type
+	db.Creator = Creator
+
+	header := t.NewTEXtHeader()
+	header.TextLength = uint32(len(d.Text))
+	header.CurrentPosition = uint32(d.Position)
+	if d.Uncompressed {
+		header.Compression = compressionNone
+	}
+
+	records := make([]pdb.Record, 0)
+	for i := 0; i < len(d.Text); i += RecordSize {
+		text := []byte(d.Text[i:min(i+RecordSize, len(d.Text))])
+		if !d.Uncompressed {
+			text = Compress(text)
+		}
+		records = append(records, pdb.RawRecord(text))
+	}
+	header.TextRecordCount = uint16(len(records))
+
+	db.AddRecord(pdb.RawRecord(bytesSequential(header)))
+	for _, rec := range records {
+		db.AddRecord(rec)
+	}
+	for _, bm := range d.Bookmarks {
+		entry := t.TEXtBookmark{Offset: uint32(bm.Offset)}
+		copy(entry.Name[:len(entry.Name)-1], bm.Name)
+		db.AddRecord(pdb.RawRecord(bytesSequential(entry)))
+	}
+
+	return db
+}
+
+// Read reads the document stored in the PalmDOC database db.
+func Read(db pdb.Database) (Document, error) {
+	if db.Type != Type || db.Creator != Creator || len(db.Records) == 0 {
+		return Document{}, ErrNotPalmDOC
+	}
+
+	header := t.TEXtHeader{}
+	err := readRecord(db.Records[0], &header)
+	if err != nil {
+		return Document{}, err
+	}
+	if header.Compression != compressionNone && header.Compression != compressionPalmDOC {
+		return Document{}, ErrUnsupportedCompression
+	}
+	count := int(header.TextRecordCount)
+	if count >= len(db.Records) {
+		return Document{}, ErrNotPalmDOC
+	}
+
+	text := bytes.NewBuffer(nil)
+	for _, rec := range db.Records[1 : 1+count] {
+		data, err := recordBytes(rec)
+		if err != nil {
+			return Document{}, err
+		}
+		if header.Compression == compressionPalmDOC {
+			data, err = Decompress(data)
+			if err != nil {
+				return Document{}, err
+			}
+		}
+		text.Write(data)
+	}
+
+	// Bookmarks follow the text records, other trailing records such
+	// as notes or images are skipped
+	bookmarks := make([]Bookmark, 0)
+	for _, rec := range db.Records[1+count:] {
+		entry := t.TEXtBookmark{}
+		data, err := recordBytes(rec)
+		if err != nil {
+			return Document{}, err
+		}
+		if len(data) != binary.Size(entry) {
+			continue
+		}
+		err = binary.Read(bytes.NewReader(data), pdb.Endian, &entry)
+		if err != nil {
+			return Document{}, err
+		}
+		bookmarks = append(bookmarks, Bookmark{
+			Name:   string(bytes.TrimRight(entry.Name[:], "\x00")),
+			Offset: int(entry.Offset),
+		})
+	}
+
+	return Document{
+		Title:        db.Name,
+		Date:         db.Date,
+		Text:         text.String(),
+		Position:     int(header.CurrentPosition),
+		Bookmarks:    bookmarks,
+		Uncompressed: header.Compression == compressionNone,
+	}, nil
+}
+
+// readRecord decodes the fixed-size structure v from rec, which must
+// have exactly the size of v.
+func readRecord(rec pdb.Record, v interface{}) error {
+	data, err := recordBytes(rec)
+	if err != nil {
+		return err
+	}
+	if len(data) != binary.Size(v) {
+		return ErrNotPalmDOC
+	}
+
+	return binary.Read(bytes.NewReader(data), pdb.Endian, v)
+}
+
+func recordBytes(rec pdb.Record) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := rec.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func bytesSequential(v interface{}) []byte {
+	buf := bytes.NewBuffer(nil)
+	err := binary.Write(buf, pdb.Endian, v)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
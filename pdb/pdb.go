@@ -12,9 +12,15 @@ import (
 var Endian = binary.BigEndian
 
 // Database represents an in-memory Palm database.
+//
+// Type and Creator identify the format of the database and the
+// application it belongs to.  Empty values are written as "BOOK" and
+// "MOBI" respectively.
 type Database struct {
 	Name    string
 	Date    time.Time
+	Type    string
+	Creator string
 	Records []Record
 }
 
@@ -23,6 +29,8 @@ func NewDatabase(name string, date time.Time) Database {
 	return Database{
 		Name:    trimZeroes(name),
 		Date:    date,
+		Type:    "BOOK",
+		Creator: "MOBI",
 		Records: []Record{},
 	}
 }
@@ -47,10 +55,26 @@ func (d *Database) ReplaceRecord(i int, r Record) {
 	d.Records[i] = r
 }
 
+// InsertRecord inserts a record at index i in the Palm database, so
+// that all following records move back by one.
+//
+// Panics if index i is out of range.
+func (d *Database) InsertRecord(i int, r Record) {
+	d.Records = append(d.Records[:i], append([]Record{r}, d.Records[i:]...)...)
+}
+
 // Write writes out the binary representation of the Palm database to w.
 func (d Database) Write(w io.Writer) error {
 	rnum := len(d.Records)
 	palmDBHeader := NewPalmDBHeader(d.Name, d.Date, uint16(rnum), uint32(rnum)*2-1)
+	if len(d.Type) > 0 {
+		palmDBHeader.Type = [4]byte{}
+		copy(palmDBHeader.Type[:], d.Type)
+	}
+	if len(d.Creator) > 0 {
+		palmDBHeader.Creator = [4]byte{}
+		copy(palmDBHeader.Creator[:], d.Creator)
+	}
 	err := binary.Write(w, Endian, palmDBHeader)
 	if err != nil {
 		return err
@@ -139,6 +163,8 @@ func ReadDatabase(r io.Reader) (*Database, error) {
 	return &Database{
 		Name:    name,
 		Date:    date,
+		Type:    trimZeroes(string(palmDBHeader.Type[:])),
+		Creator: trimZeroes(string(palmDBHeader.Creator[:])),
 		Records: records,
 	}, nil
 }
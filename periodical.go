@@ -0,0 +1,146 @@
+package mobi
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+)
+
+// ErrInvalidPeriodical is returned when a periodical has no sections
+// or contains a section without articles, which Kindle readers are
+// unable to navigate.
+var ErrInvalidPeriodical = errors.New("mobi: invalid periodical")
+
+// Periodical represents all the information necessary to generate a
+// KF8-style formatted newspaper or magazine.
+//
+// Metadata and resources are taken from the embedded Book, while its
+// chapters are ignored and instead generated from the articles of the
+// periodical.  Kindle readers use the resulting hierarchy of sections
+// and articles for their periodical navigation interface.
+type Periodical struct {
+	Book
+	Magazine bool
+	Masthead image.Image
+	Sections []Section
+}
+
+// Section represents a section of a Periodical.
+type Section struct {
+	Title    string
+	Articles []Article
+}
+
+// Article represents an article in a Section.
+//
+// The description and author of an article are displayed in the
+// periodical navigation interface of Kindle readers.
+type Article struct {
+	Title       string
+	Description string
+	Author      string
+	Chunks      []Chunk
+}
+
+// Realize converts a Periodical to a PalmDB Database.
+//
+// Panics if the periodical cannot be converted.  Use TryRealize in
+// order to handle such errors.
+func (p Periodical) Realize() pdb.Database {
+	db, err := p.TryRealize()
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
+// TryRealize converts a Periodical to a PalmDB Database.
+//
+// Returns ErrInvalidPeriodical if the periodical has no sections or
+// one of its sections has no articles.
+func (p Periodical) TryRealize() (pdb.Database, error) {
+	if len(p.Sections) == 0 {
+		return pdb.Database{}, ErrInvalidPeriodical
+	}
+	for _, sec := range p.Sections {
+		if len(sec.Articles) == 0 {
+			return pdb.Database{}, fmt.Errorf("%w: section %q has no articles", ErrInvalidPeriodical, sec.Title)
+		}
+	}
+
+	m := p.Book
+	m.Chapters = make([]Chapter, 0)
+	for _, sec := range p.Sections {
+		for _, art := range sec.Articles {
+			m.Chapters = append(m.Chapters, Chapter{
+				Title:  art.Title,
+				Chunks: art.Chunks,
+			})
+		}
+	}
+	if p.Masthead != nil {
+		m.Images = append(m.Images[:len(m.Images):len(m.Images)], p.Masthead)
+	}
+	if len(m.DocType) == 0 {
+		m.DocType = p.docType()
+	}
+	m.periodical = &p
+
+	return m.TryRealize()
+}
+
+func (p Periodical) docType() string {
+	if p.Magazine {
+		return DocTypeMAGZ
+	}
+
+	return DocTypeNWPR
+}
+
+func (p Periodical) mobiType() uint32 {
+	if p.Magazine {
+		return 0x103 // News magazine
+	}
+
+	return 0x101 // News
+}
+
+func (p Periodical) info(chaps []r.ChapterInfo) r.PeriodicalInfo {
+	info := r.PeriodicalInfo{
+		Title:    p.Title,
+		Masthead: -1,
+		Sections: make([]r.SectionInfo, 0),
+	}
+	if p.Masthead != nil {
+		info.Masthead = len(p.Images)
+	}
+
+	i := 0
+	for _, sec := range p.Sections {
+		section := r.SectionInfo{
+			Title:    sec.Title,
+			Start:    info.Start + info.Length,
+			Articles: make([]r.ArticleInfo, 0),
+		}
+		for _, art := range sec.Articles {
+			chap := chaps[i]
+			section.Articles = append(section.Articles, r.ArticleInfo{
+				Title:       art.Title,
+				Description: art.Description,
+				Author:      art.Author,
+				Start:       chap.Start,
+				Length:      chap.Length,
+			})
+			section.Length += chap.Length
+			i++
+		}
+		info.Sections = append(info.Sections, section)
+		info.Length += section.Length
+	}
+
+	return info
+}
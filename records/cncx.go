@@ -35,3 +35,54 @@ func (r CNCXRecord) LengthNoPadding() int {
 	}
 	return result
 }
+
+// MaxCNCXRecordSize is the maximum size of the strings in a single
+// CNCX record, as strings are referenced by 16-bit offsets within
+// their record.
+const MaxCNCXRecordSize = 0xFFF0
+
+type cncxBuilder struct {
+	records [][][]byte
+	offsets map[string]int
+	length  int
+}
+
+func newCNCXBuilder() *cncxBuilder {
+	return &cncxBuilder{
+		records: make([][][]byte, 0),
+		offsets: make(map[string]int),
+	}
+}
+
+// add returns the offset of the string s in the CNCX records, adding
+// it to the last record if it is not yet present.  Offsets combine the
+// number of the record with the position of s in that record.
+func (b *cncxBuilder) add(s string) int {
+	if offset, ok := b.offsets[s]; ok {
+		return offset
+	}
+
+	entry := encodeCNCXString(s)
+	if len(b.records) == 0 || b.length+len(entry) > MaxCNCXRecordSize {
+		b.records = append(b.records, make([][]byte, 0))
+		b.length = 0
+	}
+	last := len(b.records) - 1
+	offset := last<<16 | b.length
+	b.records[last] = append(b.records[last], entry)
+	b.offsets[s] = offset
+	b.length += len(entry)
+
+	return offset
+}
+
+func (b *cncxBuilder) build() []CNCXRecord {
+	result := make([]CNCXRecord, 0)
+	for _, entries := range b.records {
+		result = append(result, CNCXRecord{
+			entries: entries,
+		})
+	}
+
+	return result
+}
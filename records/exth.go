@@ -1,7 +1,9 @@
 package records
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 
 	"github.com/leotaku/mobi/pdb"
@@ -36,6 +38,41 @@ func (e *EXTHSection) AddInt(tp t.EXTHEntryType, is ...int) {
 	}
 }
 
+// Remove removes all entries with type tp.
+func (e *EXTHSection) Remove(tp t.EXTHEntryType) {
+	entries := make([]EXTHEntry, 0)
+	for _, entry := range e.entries {
+		if entry.EntryType != tp {
+			entries = append(entries, entry)
+		}
+	}
+	e.entries = entries
+}
+
+// Strings returns the data of all entries with type tp as strings.
+func (e EXTHSection) Strings(tp t.EXTHEntryType) []string {
+	result := make([]string, 0)
+	for _, entry := range e.entries {
+		if entry.EntryType == tp {
+			result = append(result, string(entry.Data))
+		}
+	}
+
+	return result
+}
+
+// Int returns the data of the first entry with type tp as an integer.
+// Returns false if there is no such entry.
+func (e EXTHSection) Int(tp t.EXTHEntryType) (int, bool) {
+	for _, entry := range e.entries {
+		if entry.EntryType == tp && len(entry.Data) == 4 {
+			return int(pdb.Endian.Uint32(entry.Data)), true
+		}
+	}
+
+	return 0, false
+}
+
 func (e EXTHSection) Write(w io.Writer) error {
 	lenNoPadding := e.LengthWithoutPadding()
 
@@ -100,3 +137,36 @@ func (e EXTHEntry) Write(w io.Writer) error {
 func (e EXTHEntry) Length() int {
 	return len(e.Data) + t.EXTHEntryHeaderLength
 }
+
+// ReadEXTHSection parses an EXTH section from the start of data.
+func ReadEXTHSection(data []byte) (EXTHSection, error) {
+	e := NewEXTHSection()
+	r := bytes.NewReader(data)
+	h := t.EXTHHeader{}
+	err := binary.Read(r, pdb.Endian, &h)
+	if err != nil {
+		return e, err
+	}
+	if h.EXTH != t.NewEXTHHeader(0, 0).EXTH {
+		return e, errors.New("records: not an EXTH section")
+	}
+
+	for i := 0; i < int(h.EntryCount); i++ {
+		eh := t.EXTHEntryHeader{}
+		err := binary.Read(r, pdb.Endian, &eh)
+		if err != nil {
+			return e, err
+		}
+		if eh.RecordLength < t.EXTHEntryHeaderLength {
+			return e, errors.New("records: invalid EXTH entry length")
+		}
+		data := make([]byte, eh.RecordLength-t.EXTHEntryHeaderLength)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return e, err
+		}
+		e.entries = append(e.entries, NewEXTHEntry(eh.RecordType, data))
+	}
+
+	return e, nil
+}
@@ -1,14 +1,27 @@
 package records
 
 import (
+	"bytes"
+	"errors"
 	"image"
 	"io"
 
 	"github.com/leotaku/mobi/jfif"
 )
 
+// ImageRecordMaxSize is the largest image record Kindle readers are
+// willing to display.
+const ImageRecordMaxSize = 127 * 1024 // 0x1FC00
+
+// ErrImageRecordTooLarge is returned when a raw image record exceeds
+// ImageRecordMaxSize.  Encoded images are not checked, as image
+// profiles already reduce them to fit.
+var ErrImageRecordTooLarge = errors.New("records: image record too large")
+
 type ImageRecord struct {
-	img image.Image
+	img  image.Image
+	raw  []byte
+	opts *jfif.Options
 }
 
 func NewImageRecord(img image.Image) ImageRecord {
@@ -17,6 +30,38 @@ func NewImageRecord(img image.Image) ImageRecord {
 	}
 }
 
+func NewImageRecordWithOptions(img image.Image, o *jfif.Options) ImageRecord {
+	return ImageRecord{
+		img:  img,
+		opts: o,
+	}
+}
+
+// NewRawImageRecord creates an image record from already encoded JPEG
+// data, which is rewritten using jfif.Rewrite with the given options.
+//
+// Returns an error if the data is not a valid JPEG or if the rewritten
+// record exceeds ImageRecordMaxSize.
+func NewRawImageRecord(data []byte, o *jfif.Options) (ImageRecord, error) {
+	buf := bytes.NewBuffer(nil)
+	err := jfif.Rewrite(buf, data, o)
+	if err != nil {
+		return ImageRecord{}, err
+	}
+	if buf.Len() > ImageRecordMaxSize {
+		return ImageRecord{}, ErrImageRecordTooLarge
+	}
+
+	return ImageRecord{
+		raw: buf.Bytes(),
+	}, nil
+}
+
 func (r ImageRecord) Write(w io.Writer) error {
-	return jfif.Encode(w, r.img, nil)
+	if r.raw != nil {
+		_, err := w.Write(r.raw)
+		return err
+	}
+
+	return jfif.EncodeWithOptions(w, r.img, r.opts)
 }
@@ -3,153 +3,177 @@ package records
 import (
 	"fmt"
 
-	"github.com/leotaku/mobi/pdb"
 	t "github.com/leotaku/mobi/types"
 )
 
-func NCXHeaderIndexRecord(entryCount int) IndexRecord {
-	bs := encodeINDXString(fmt.Sprintf("%03v", entryCount-1))
-	pad := make([]byte, 5)
-	pdb.Endian.PutUint16(pad, uint16(entryCount))
-	bs = append(bs, pad...)
-
-	return IndexRecord{
-		TAGXTable:     t.TAGXTableNCXSingle,
-		Type:          2,
-		IDXTEntries:   [][]byte{bs},
-		SubEntryCount: uint32(entryCount),
-		CNCXCount:     1,
+// NCXIndex creates the NCX index describing the given chapters.
+//
+// Books without sub-chapters use a flat index.  Otherwise, entries are
+// ordered by depth, so all top-level chapters precede their
+// sub-chapters, and every entry refers to its parent and the range of
+// its children by their position in this order.
+func NCXIndex(info []ChapterInfo) *IndexBuilder {
+	if hasSubChapters(info) {
+		return hierarchicalNCXIndex(info)
 	}
-}
 
-func SkeletonHeaderIndexRecord(entryCount int) IndexRecord {
-	bs := encodeINDXString(fmt.Sprintf("SKEL%010v", entryCount-1))
-	pad := make([]byte, 5)
-	pdb.Endian.PutUint16(pad, uint16(entryCount))
-	bs = append(bs, pad...)
-
-	return IndexRecord{
-		TAGXTable:     t.TAGXTableSkeleton,
-		Type:          2,
-		IDXTEntries:   [][]byte{bs},
-		SubEntryCount: uint32(entryCount),
+	b := NewIndexBuilder(t.TAGXTableNCXSingle)
+	for _, chap := range info {
+		b.Add(fmt.Sprintf("%03x", chap.Start), map[t.TAGXTag][]int{
+			t.TAGXTagEntryPosition:   {chap.Start},
+			t.TAGXTagEntryLength:     {chap.Length},
+			t.TAGXTagEntryNameOffset: {b.AddString(chap.Title)},
+			t.TAGXTagEntryDepthLevel: {0},
+		})
 	}
+
+	return b
 }
 
-func ChunkHeaderIndexRecord(lastPos int, entryCount int) IndexRecord {
-	bs := encodeINDXString(fmt.Sprintf("%010v", lastPos))
-	pad := make([]byte, 5)
-	pdb.Endian.PutUint16(pad, uint16(entryCount))
-	bs = append(bs, pad...)
-
-	return IndexRecord{
-		TAGXTable:     t.TAGXTableChunk,
-		Type:          2,
-		IDXTEntries:   [][]byte{bs},
-		SubEntryCount: uint32(entryCount),
-		CNCXCount:     1,
+func hierarchicalNCXIndex(info []ChapterInfo) *IndexBuilder {
+	b := NewIndexBuilder(t.TAGXTableNCX)
+	for i, entry := range flattenChapters(info) {
+		values := map[t.TAGXTag][]int{
+			t.TAGXTagEntryPosition:   {entry.Start},
+			t.TAGXTagEntryLength:     {entry.Length},
+			t.TAGXTagEntryNameOffset: {b.AddString(entry.Title)},
+			t.TAGXTagEntryDepthLevel: {entry.depth},
+		}
+		if entry.parent >= 0 {
+			values[t.TAGXTagEntryParent] = []int{entry.parent}
+		}
+		if len(entry.SubChapters) > 0 {
+			values[t.TAGXTagEntryChild1] = []int{entry.firstChild}
+			values[t.TAGXTagEntryChildN] = []int{entry.firstChild + len(entry.SubChapters) - 1}
+		}
+		b.Add(fmt.Sprintf("%03x", i), values)
 	}
+
+	return b
 }
 
-func NCXIndexRecord(info []ChapterInfo) (IndexRecord, CNCXRecord) {
-	idxtEntries := make([][]byte, 0)
-	cncxEntries := make([][]byte, 0)
-	cncxOffset := 0
+// ncxEntry is a chapter with its position in the hierarchy.
+type ncxEntry struct {
+	ChapterInfo
+	depth      int
+	parent     int
+	firstChild int
+}
+
+// flattenChapters returns all chapters and sub-chapters ordered by
+// depth, where the children of each entry are adjacent.
+func flattenChapters(info []ChapterInfo) []ncxEntry {
+	entries := make([]ncxEntry, 0)
 	for _, chap := range info {
-		// CNCX entries
-		cncx := encodeCNCXString(chap.Title)
-		cncxEntries = append(cncxEntries, cncx)
-
-		label := encodeINDXString(fmt.Sprintf("%03x", chap.Start))
-		bs := bytesSequential(pdb.Endian,
-			label,
-			calculateControlByte(t.TAGXTableChunk),
-			encodeVwi(chap.Start),  // Record offset
-			encodeVwi(chap.Length), // Length of a record
-			encodeVwi(cncxOffset),  // Label offset relative to CNXC record
-			encodeVwi(0),           // Null
-		)
-		idxtEntries = append(idxtEntries, bs)
-		cncxOffset += len(cncx)
+		entries = append(entries, ncxEntry{ChapterInfo: chap, depth: 0, parent: -1})
 	}
-
-	return IndexRecord{
-			Type:          0,
-			HeaderType:    1,
-			IDXTEntries:   idxtEntries,
-			SubEntryCount: 0,
-		}, CNCXRecord{
-			entries: cncxEntries,
+	for i := 0; i < len(entries); i++ {
+		entries[i].firstChild = len(entries)
+		for _, sub := range entries[i].SubChapters {
+			entries = append(entries, ncxEntry{ChapterInfo: sub, depth: entries[i].depth + 1, parent: i})
 		}
+	}
+
+	return entries
 }
 
-func SkeletonIndexRecord(info []ChunkInfo) IndexRecord {
-	entries := make([][]byte, 0)
-	for i, chunk := range info {
-		label := encodeINDXString(fmt.Sprintf("SKEL%010v", i))
-		bs := bytesSequential(pdb.Endian,
-			label,
-			calculateControlByte(t.TAGXTableSkeleton),
-			encodeVwi(1),
-			encodeVwi(1),
-			encodeVwi(chunk.PreStart),
-			encodeVwi(chunk.PreLength),
-		)
-		entries = append(entries, bs)
+func hasSubChapters(info []ChapterInfo) bool {
+	for _, chap := range info {
+		if len(chap.SubChapters) > 0 {
+			return true
+		}
 	}
 
-	return IndexRecord{
-		Type:        0,
-		HeaderType:  1,
-		IDXTEntries: entries,
+	return false
+}
+
+// SkeletonIndex creates the skeleton index describing the given
+// skeletons.
+func SkeletonIndex(info []SkeletonInfo) *IndexBuilder {
+	b := NewIndexBuilder(t.TAGXTableSkeleton)
+	for i, skel := range info {
+		// Readers expect both tags to be repeated
+		b.Add(fmt.Sprintf("SKEL%010v", i), map[t.TAGXTag][]int{
+			t.TAGXTagSkeletonChunkCount: {skel.ChunkCount, skel.ChunkCount},
+			t.TAGXTagSkeletonGeometry:   {skel.Start, skel.Length, skel.Start, skel.Length},
+		})
 	}
+
+	return b
 }
 
-func ChunkIndexRecord(info []ChunkInfo) (IndexRecord, CNCXRecord) {
-	idxtEntries := make([][]byte, 0)
-	cncxEntries := make([][]byte, 0)
-	cncxOffset := 0
+// ChunkIndex creates the chunk index describing the given chunks.
+func ChunkIndex(info []ChunkInfo) *IndexBuilder {
+	b := NewIndexBuilder(t.TAGXTableChunk)
 	for i, chunk := range info {
-		// CNCX entries
-		s := fmt.Sprintf("P-//*[@aid='%v']", To32(i))
-		cncx := encodeCNCXString(s)
-		cncxEntries = append(cncxEntries, cncx)
-
-		label := encodeINDXString(fmt.Sprintf("%010v", chunk.ContentStart))
-		bs := bytesSequential(pdb.Endian,
-			label,
-			calculateControlByte(t.TAGXTableChunk),
-			encodeVwi(cncxOffset),          // CNCX offset
-			encodeVwi(i),                   // File number
-			encodeVwi(i),                   // Sequence number
-			encodeVwi(0),                   // Geometry start
-			encodeVwi(chunk.ContentLength), // Geometry length
-		)
-		idxtEntries = append(idxtEntries, bs)
-		cncxOffset += len(cncx)
+		selector := fmt.Sprintf("P-//*[@aid='%v']", chunk.Selector)
+		b.Add(fmt.Sprintf("%010v", chunk.InsertPos), map[t.TAGXTag][]int{
+			t.TAGXTagChunkCNCXOffset:     {b.AddString(selector)},
+			t.TAGXTagChunkFileNumber:     {chunk.FileNumber},
+			t.TAGXTagChunkSequenceNumber: {i},
+			t.TAGXTagChunkGeometry:       {chunk.Start, chunk.Length},
+		})
 	}
 
-	return IndexRecord{
-			Type:          0,
-			HeaderType:    1,
-			IDXTEntries:   idxtEntries,
-			SubEntryCount: 0,
-		}, CNCXRecord{
-			entries: cncxEntries,
-		}
+	return b
+}
+
+// GuideIndex creates the guide index describing the given references.
+func GuideIndex(info []GuideInfo) *IndexBuilder {
+	b := NewIndexBuilder(t.TAGXTableGuide)
+	for _, ref := range info {
+		b.Add(ref.Type, map[t.TAGXTag][]int{
+			t.TAGXTagGuideTitle:  {b.AddString(ref.Title)},
+			t.TAGXTagGuidePosFid: {ref.FID, ref.Offset},
+		})
+	}
+
+	return b
+}
+
+// SkeletonInfo describes the skeleton section of a KF8 HTML file,
+// into which ChunkCount chunks are inserted.
+type SkeletonInfo struct {
+	Start      int
+	Length     int
+	ChunkCount int
 }
 
+// ChunkInfo describes a chunk of a KF8 HTML file.
+//
+// InsertPos is the position in the text at which the chunk is
+// inserted into its skeleton, after all previous chunks of the same
+// file have been inserted.  Start is the offset of the chunk relative
+// to the first chunk of the same file, and Selector is the 'aid'
+// attribute of the element that contains the chunk.
 type ChunkInfo struct {
-	PreStart      int
-	PreLength     int
-	ContentStart  int
-	ContentLength int
+	InsertPos  int
+	Selector   string
+	FileNumber int
+	Start      int
+	Length     int
 }
 
-type ChapterInfo struct {
+// GuideInfo describes a reference in the guide of a book, such as the
+// location at which reading starts.
+//
+// Type is the kind of the reference as used in OPF guides.  The
+// location of the reference is described by the chunk with sequence
+// number FID and the Offset relative to that chunk.
+type GuideInfo struct {
+	Type   string
 	Title  string
-	Start  int
-	Length int
+	FID    int
+	Offset int
+}
+
+// ChapterInfo describes a chapter of a book in the NCX index.  The
+// range of a chapter includes the ranges of all its sub-chapters.
+type ChapterInfo struct {
+	Title       string
+	Start       int
+	Length      int
+	SubChapters []ChapterInfo
 }
 
 func encodeINDXString(label string) []byte {
@@ -1,13 +1,24 @@
 package records
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/bits"
 
 	"github.com/leotaku/mobi/pdb"
 	t "github.com/leotaku/mobi/types"
+	"golang.org/x/text/encoding/charmap"
 )
 
+// ErrIndexRecordTooLarge is returned when the entries of an index
+// record cannot be referenced by 16-bit offsets.  Indices built using
+// an IndexBuilder are split into multiple records to avoid this.
+var ErrIndexRecordTooLarge = errors.New("records: index record too large")
+
 type IndexRecord struct {
 	Type          uint32
 	HeaderType    uint32
@@ -33,6 +44,7 @@ func (r IndexRecord) Write(w io.Writer) error {
 	// TAGX variables
 	if len(r.TAGXTable) > 0 {
 		inh.TAGXOffset = t.INDXHeaderLength
+		th.ControlByteCount = uint32(r.TAGXTable.ControlByteCount())
 		th.HeaderLength += uint32(len(r.TAGXTable) * t.TAGXTagLength)
 		offset += int(th.HeaderLength)
 	} else {
@@ -48,6 +60,9 @@ func (r IndexRecord) Write(w io.Writer) error {
 		offset += length
 		idxtLength += length
 	}
+	if r.Length() > MaxIndexRecordSize {
+		return ErrIndexRecordTooLarge
+	}
 	inh.IDXTStart = uint32(offset + idxtLength%4)
 	inh.IndexEntryCount = r.SubEntryCount
 
@@ -98,3 +113,424 @@ func (r IndexRecord) LengthNoPadding() int {
 
 	return length
 }
+
+// Index is the decoded content of an index, which consists of a
+// header record followed by data records and CNCX records.
+type Index struct {
+	Header    t.INDXHeader
+	TAGXTable t.TAGXTagTable
+	Entries   []IndexEntry
+	CNCX      map[int]string
+}
+
+// IndexEntry is a decoded entry of an index.  Tag values are keyed by
+// tag number, independent of the bitmask used by the TAGX table.
+type IndexEntry struct {
+	Label string
+	Tags  map[byte][]int
+}
+
+// Get returns the values of the given tag, or nil if the entry does
+// not contain any values for the tag.
+func (e IndexEntry) Get(tag t.TAGXTag) []int {
+	num, _, _, _ := deconstructTag(tag)
+	return e.Tags[num]
+}
+
+// String returns the CNCX string referenced by the given tag value,
+// which combines the CNCX record number and the offset of the string.
+func (i Index) String(offset int) (string, bool) {
+	s, ok := i.CNCX[offset]
+	return s, ok
+}
+
+// ReadIndex decodes the index with the header record at idx, where
+// recs contains the data of all records of a database.
+//
+// Labels are decoded using the ORDT table of the index if it has one,
+// as is common for dictionaries, and using the encoding of the index
+// otherwise.
+func ReadIndex(recs [][]byte, idx int) (Index, error) {
+	if idx < 0 || idx >= len(recs) {
+		return Index{}, io.ErrUnexpectedEOF
+	}
+	header, err := readINDXHeader(recs[idx])
+	if err != nil {
+		return Index{}, err
+	}
+	tagx, cbCount, err := readTAGXTable(recs[idx], header.TAGXOffset)
+	if err != nil {
+		return Index{}, err
+	}
+	labels := newLabelDecoder(recs[idx], header)
+
+	result := Index{
+		Header:    header,
+		TAGXTable: tagx,
+		Entries:   make([]IndexEntry, 0, header.IndexEntryCount),
+		CNCX:      make(map[int]string),
+	}
+	first := idx + 1
+	last := first + int(header.IndexRecordCount)
+	if last > len(recs) {
+		return Index{}, io.ErrUnexpectedEOF
+	}
+	for _, rec := range recs[first:last] {
+		h, err := readINDXHeader(rec)
+		if err != nil {
+			return Index{}, err
+		}
+		offsets, err := readIDXT(rec, h)
+		if err != nil {
+			return Index{}, err
+		}
+		for i, start := range offsets {
+			end := int(h.IDXTStart)
+			if i+1 < len(offsets) {
+				end = offsets[i+1]
+			}
+			if start >= end || end > len(rec) {
+				return Index{}, errInvalidIndex
+			}
+			entry, err := decodeIndexEntry(rec[start:end], tagx, cbCount, labels)
+			if err != nil {
+				return Index{}, err
+			}
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+
+	// CNCX records directly follow the data records
+	for i := 0; i < int(header.CNCXCount) && last+i < len(recs); i++ {
+		data := recs[last+i]
+		for pos := 0; pos < len(data); {
+			length, n := decodeVwi(data[pos:])
+			if n == 0 || length == 0 || pos+n+length > len(data) {
+				break
+			}
+			result.CNCX[i<<16|pos] = string(data[pos+n : pos+n+length])
+			pos += n + length
+		}
+	}
+
+	return result, nil
+}
+
+var errInvalidIndex = errors.New("records: invalid index record")
+
+func readINDXHeader(data []byte) (t.INDXHeader, error) {
+	h := t.INDXHeader{}
+	err := binary.Read(bytes.NewReader(data), pdb.Endian, &h)
+	if err != nil {
+		return h, err
+	}
+	if h.INDX != t.NewINDXHeader(0, 0).INDX {
+		return h, errInvalidIndex
+	}
+
+	return h, nil
+}
+
+func readTAGXTable(data []byte, offset uint32) (t.TAGXTagTable, int, error) {
+	start := int(offset)
+	if start+t.TAGXHeaderLength > len(data) || string(data[start:start+4]) != "TAGX" {
+		return nil, 0, errInvalidIndex
+	}
+	length := int(pdb.Endian.Uint32(data[start+4:]))
+	cbCount := int(pdb.Endian.Uint32(data[start+8:]))
+	if start+length > len(data) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	tagx := make(t.TAGXTagTable, 0)
+	for pos := start + t.TAGXHeaderLength; pos+t.TAGXTagLength <= start+length; pos += t.TAGXTagLength {
+		tagx = append(tagx, t.TAGXTag(pdb.Endian.Uint32(data[pos:])))
+	}
+
+	return tagx, cbCount, nil
+}
+
+// readIDXT returns the offsets of all entries of an index record.
+func readIDXT(data []byte, h t.INDXHeader) ([]int, error) {
+	start := int(h.IDXTStart)
+	count := int(h.IndexRecordCount)
+	if start+t.IDXTHeaderLength+2*count > len(data) || string(data[start:start+4]) != "IDXT" {
+		return nil, errInvalidIndex
+	}
+
+	offsets := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		pos := start + t.IDXTHeaderLength + 2*i
+		offsets = append(offsets, int(pdb.Endian.Uint16(data[pos:])))
+	}
+
+	return offsets, nil
+}
+
+// labelDecoder converts the raw bytes of entry labels to strings.
+type labelDecoder func([]byte) string
+
+func newLabelDecoder(data []byte, h t.INDXHeader) labelDecoder {
+	// The ORDT tables are described by fields in the unknown part of
+	// the INDX header, where the entry count is stored at offset 0xA8
+	// and the ORDT2 table of 16-bit code points at offset 0xB0
+	ordtCount := int(pdb.Endian.Uint32(h.Unknown2[112:]))
+	ordtStart := int(pdb.Endian.Uint32(h.Unknown2[120:]))
+	if ordtCount > 0 && ordtStart+4+2*ordtCount <= len(data) && string(data[ordtStart:ordtStart+4]) == "ORDT" {
+		ordt := make([]rune, ordtCount)
+		for i := range ordt {
+			ordt[i] = rune(pdb.Endian.Uint16(data[ordtStart+4+2*i:]))
+		}
+		return func(label []byte) string {
+			runes := make([]rune, 0, len(label))
+			for _, b := range label {
+				if int(b) < len(ordt) {
+					runes = append(runes, ordt[b])
+				} else {
+					runes = append(runes, rune(b))
+				}
+			}
+			return string(runes)
+		}
+	}
+
+	if h.IndexEncoding == 1252 {
+		decoder := charmap.Windows1252.NewDecoder()
+		return func(label []byte) string {
+			s, err := decoder.Bytes(label)
+			if err != nil {
+				return string(label)
+			}
+			return string(s)
+		}
+	}
+
+	return func(label []byte) string {
+		return string(label)
+	}
+}
+
+// decodeIndexEntry decodes a single entry of an index record, which
+// consists of the label, control bytes and tag values.
+func decodeIndexEntry(data []byte, tagx t.TAGXTagTable, cbCount int, labels labelDecoder) (IndexEntry, error) {
+	if len(data) == 0 || 1+int(data[0])+cbCount > len(data) {
+		return IndexEntry{}, errInvalidIndex
+	}
+	labelEnd := 1 + int(data[0])
+	label := labels(data[1:labelEnd])
+	cbs := data[labelEnd : labelEnd+cbCount]
+	data = data[labelEnd+cbCount:]
+
+	// Determine the number of values or bytes for each tag, as all
+	// counts precede the values
+	type pattern struct {
+		tag        byte
+		count      int
+		valueBytes int
+	}
+	patterns := make([]pattern, 0)
+	cb := 0
+	for _, tag := range tagx {
+		num, nvals, mask, end := deconstructTag(tag)
+		if end == 1 {
+			cb++
+			continue
+		}
+		if cb >= len(cbs) {
+			return IndexEntry{}, errInvalidIndex
+		}
+		value := cbs[cb] & mask
+		switch {
+		case value == 0:
+		case value == mask && bits.OnesCount8(mask) > 1:
+			n, consumed := decodeVwi(data)
+			data = data[consumed:]
+			patterns = append(patterns, pattern{tag: num, valueBytes: n})
+		default:
+			value >>= bits.TrailingZeros8(mask)
+			patterns = append(patterns, pattern{tag: num, count: int(value) * int(nvals)})
+		}
+	}
+
+	tags := make(map[byte][]int)
+	for _, p := range patterns {
+		values := make([]int, 0)
+		if p.valueBytes > 0 {
+			for consumed := 0; consumed < p.valueBytes && len(data) > 0; {
+				v, n := decodeVwi(data)
+				values = append(values, v)
+				data = data[n:]
+				consumed += n
+			}
+		} else {
+			for i := 0; i < p.count && len(data) > 0; i++ {
+				v, n := decodeVwi(data)
+				values = append(values, v)
+				data = data[n:]
+			}
+		}
+		tags[p.tag] = values
+	}
+
+	return IndexEntry{Label: label, Tags: tags}, nil
+}
+
+// MaxIndexRecordSize is the maximum size of a single INDX record, as
+// entries are referenced using 16-bit offsets.
+const MaxIndexRecordSize = 0x10000
+
+// IndexBuilder builds an index whose entries are described by a TAGX
+// table.
+//
+// Entries are written in the order in which they are added and split
+// into as many data records as required to stay below
+// MaxIndexRecordSize.  Strings referenced by entries are collected in
+// the CNCX records of the index.
+type IndexBuilder struct {
+	tagx    t.TAGXTagTable
+	labels  []string
+	entries [][]byte
+	cncx    *cncxBuilder
+}
+
+// NewIndexBuilder creates an empty index with the given TAGX table.
+func NewIndexBuilder(tagx t.TAGXTagTable) *IndexBuilder {
+	return &IndexBuilder{
+		tagx:    tagx,
+		labels:  make([]string, 0),
+		entries: make([][]byte, 0),
+		cncx:    newCNCXBuilder(),
+	}
+}
+
+// Add adds an entry with the given label and tag values to the index.
+//
+// The number of values of each tag must be a multiple of the number of
+// values per entry declared by the TAGX table.  Add panics if a tag is
+// not part of the table or if its values cannot be described by the
+// control byte bitmask of the tag.
+func (b *IndexBuilder) Add(label string, values map[t.TAGXTag][]int) {
+	if len(label) > math.MaxUint8 {
+		panic(fmt.Sprintf("records: index label too long: %q", label))
+	}
+	for tag := range values {
+		if !b.tagx.Contains(tag) {
+			panic(fmt.Sprintf("records: tag %08x not in TAGX table", uint32(tag)))
+		}
+	}
+
+	cbs := make([]byte, 0, b.tagx.ControlByteCount())
+	sizes := bytes.NewBuffer(nil)
+	cb := byte(0)
+	for _, tag := range b.tagx {
+		_, nvals, mask, end := deconstructTag(tag)
+		if end == 1 {
+			cbs = append(cbs, cb)
+			cb = 0
+			continue
+		}
+		vs := values[tag]
+		if len(vs) == 0 {
+			continue
+		}
+		if nvals == 0 || len(vs)%int(nvals) != 0 {
+			panic(fmt.Sprintf("records: invalid number of values for tag %08x", uint32(tag)))
+		}
+
+		// Counts which fill the whole bitmask are instead written as
+		// the size of the values in bytes after the control bytes
+		shift := bits.TrailingZeros8(mask)
+		count := len(vs) / int(nvals)
+		switch {
+		case count < int(mask>>shift) || count == 1:
+			cb |= byte(count) << shift
+		case bits.OnesCount8(mask) > 1:
+			cb |= mask
+			size := 0
+			for _, v := range vs {
+				size += len(encodeVwi(v))
+			}
+			sizes.Write(encodeVwi(size))
+		default:
+			panic(fmt.Sprintf("records: too many values for tag %08x", uint32(tag)))
+		}
+	}
+
+	buf := bytes.NewBuffer(encodeINDXString(label))
+	buf.Write(cbs)
+	buf.Write(sizes.Bytes())
+	for _, tag := range b.tagx {
+		for _, v := range values[tag] {
+			buf.Write(encodeVwi(v))
+		}
+	}
+	b.labels = append(b.labels, label)
+	b.entries = append(b.entries, buf.Bytes())
+}
+
+// AddString adds s to the CNCX records of the index and returns the
+// offset that refers to it.  Equal strings share the same offset.
+func (b *IndexBuilder) AddString(s string) int {
+	return b.cncx.add(s)
+}
+
+// Len returns the number of entries in the index.
+func (b *IndexBuilder) Len() int {
+	return len(b.entries)
+}
+
+// Records returns all records of the index, consisting of the header
+// record followed by the data records and CNCX records.
+//
+// The header record lists the last label and entry count of every data
+// record, so readers can find entries without decoding all records.
+func (b *IndexBuilder) Records() []pdb.Record {
+	data := make([]IndexRecord, 0)
+	headerEntries := make([][]byte, 0)
+	flush := func(entries [][]byte, last int) {
+		data = append(data, IndexRecord{
+			Type:        0,
+			HeaderType:  1,
+			IDXTEntries: entries,
+		})
+		bs := encodeINDXString(b.labels[last])
+		pad := make([]byte, 5)
+		pdb.Endian.PutUint16(pad, uint16(len(entries)))
+		headerEntries = append(headerEntries, append(bs, pad...))
+	}
+
+	// Reserve space for the headers and worst-case padding
+	const overhead = t.INDXHeaderLength + t.IDXTHeaderLength + 3 + 3
+	entries := make([][]byte, 0)
+	size := overhead
+	for i, entry := range b.entries {
+		if len(entries) > 0 && size+len(entry)+2 > MaxIndexRecordSize {
+			flush(entries, i-1)
+			entries = make([][]byte, 0)
+			size = overhead
+		}
+		entries = append(entries, entry)
+		size += len(entry) + 2
+	}
+	if len(entries) > 0 {
+		flush(entries, len(b.entries)-1)
+	}
+
+	cncx := b.cncx.build()
+
+	records := []pdb.Record{IndexRecord{
+		TAGXTable:     b.tagx,
+		Type:          2,
+		IDXTEntries:   headerEntries,
+		SubEntryCount: uint32(len(b.entries)),
+		CNCXCount:     uint32(len(cncx)),
+	}}
+	for _, rec := range data {
+		records = append(records, rec)
+	}
+	for _, rec := range cncx {
+		records = append(records, rec)
+	}
+
+	return records
+}
@@ -1,7 +1,9 @@
 package records
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 
 	"github.com/leotaku/mobi/pdb"
@@ -60,3 +62,101 @@ func (n NullRecord) Write(w io.Writer) error {
 	_, err = w.Write(pad)
 	return err
 }
+
+// ReadNullRecord parses the null record data of a MOBI book.
+//
+// Only the MOBI header fields present in the data are filled in, so
+// reading books with a header shorter than that of KF8 books leaves
+// the KF8-specific fields at their default values.
+func ReadNullRecord(data []byte) (NullRecord, error) {
+	n := NewNullRecord("")
+	r := bytes.NewReader(data)
+	err := binary.Read(r, pdb.Endian, &n.PalmDocHeader)
+	if err != nil {
+		return n, err
+	}
+	err = binary.Read(r, pdb.Endian, &n.MOBIHeader.MOBIHeader)
+	if err != nil {
+		return n, err
+	}
+	if n.MOBIHeader.MOBI != t.NewMOBIHeader().MOBI {
+		return n, errors.New("records: not a MOBI null record")
+	}
+	if n.MOBIHeader.HeaderLength >= t.KF8HeaderLength {
+		r := bytes.NewReader(data[t.PalmDocHeaderLength:])
+		err := binary.Read(r, pdb.Endian, &n.MOBIHeader)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// Read EXTH header
+	exthStart := t.PalmDocHeaderLength + int(n.MOBIHeader.HeaderLength)
+	if n.MOBIHeader.EXTHFlags&0x40 != 0 && exthStart < len(data) {
+		n.EXTHSection, err = ReadEXTHSection(data[exthStart:])
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// Read full name
+	start := int(n.MOBIHeader.FullNameOffset)
+	end := start + int(n.MOBIHeader.FullNameLength)
+	if start > len(data) || end > len(data) {
+		return n, io.ErrUnexpectedEOF
+	}
+	n.FullName = string(data[start:end])
+
+	return n, nil
+}
+
+// RewriteNullRecord rewrites the null record data using the headers,
+// EXTH section and full name of n, which has usually been read from
+// the same data.
+//
+// Header fields unknown to this package are preserved, as are the
+// length of the MOBI header and the length of the padding after the
+// full name, which is rounded up to a multiple of four bytes.  The
+// fields that describe the EXTH section and full name are updated
+// accordingly.
+func RewriteNullRecord(data []byte, n NullRecord) ([]byte, error) {
+	orig, err := ReadNullRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	headerEnd := t.PalmDocHeaderLength + int(orig.MOBIHeader.HeaderLength)
+	nameEnd := int(orig.MOBIHeader.FullNameOffset + orig.MOBIHeader.FullNameLength)
+	if orig.MOBIHeader.HeaderLength < t.MOBIHeaderLength || headerEnd > len(data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// Only overwrite the header fields that have been read
+	n.MOBIHeader.HeaderLength = orig.MOBIHeader.HeaderLength
+	n.MOBIHeader.EXTHFlags |= 0x40
+	n.MOBIHeader.FullNameOffset = uint32(headerEnd + n.EXTHSection.Length())
+	n.MOBIHeader.FullNameLength = uint32(len(n.FullName))
+	var header interface{} = n.MOBIHeader.MOBIHeader
+	if n.MOBIHeader.HeaderLength >= t.KF8HeaderLength {
+		header = n.MOBIHeader
+	}
+	buf := bytes.NewBuffer(nil)
+	err = writeSequential(buf, pdb.Endian, n.PalmDocHeader, header)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(data[buf.Len():headerEnd])
+
+	err = n.EXTHSection.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(n.FullName)
+	pad := len(data) - nameEnd
+	if pad < 2 {
+		pad = 2
+	}
+	pad += invMod(buf.Len()+pad, 4)
+	buf.Write(make([]byte, pad))
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package records
+
+import (
+	"fmt"
+
+	t "github.com/leotaku/mobi/types"
+)
+
+// PeriodicalInfo describes the hierarchical navigation structure of
+// a periodical.
+//
+// Masthead is the index of the masthead image relative to the first
+// image record, or a negative value if the periodical has none.
+type PeriodicalInfo struct {
+	Title    string
+	Start    int
+	Length   int
+	Masthead int
+	Sections []SectionInfo
+}
+
+// SectionInfo describes a section of a periodical.
+type SectionInfo struct {
+	Title    string
+	Start    int
+	Length   int
+	Articles []ArticleInfo
+}
+
+// ArticleInfo describes an article in a section of a periodical.
+type ArticleInfo struct {
+	Title       string
+	Description string
+	Author      string
+	Start       int
+	Length      int
+}
+
+// EntryCount returns the number of index entries required to
+// represent the periodical.
+func (p PeriodicalInfo) EntryCount() int {
+	count := 1 + len(p.Sections)
+	for _, sec := range p.Sections {
+		count += len(sec.Articles)
+	}
+
+	return count
+}
+
+// PeriodicalIndex creates the NCX index of a periodical.
+//
+// Entries are ordered by depth, so the periodical entry is followed by
+// all sections, which are in turn followed by all articles.  Every
+// entry refers to its parent and the range of its children by their
+// position in this order.
+func PeriodicalIndex(info PeriodicalInfo) *IndexBuilder {
+	b := NewIndexBuilder(t.TAGXTablePeriodical)
+	entries := make([]map[t.TAGXTag][]int, 0)
+
+	// Periodical entry
+	firstSection := 1
+	firstArticle := firstSection + len(info.Sections)
+	periodical := map[t.TAGXTag][]int{
+		t.TAGXTagEntryPosition:   {info.Start},
+		t.TAGXTagEntryLength:     {info.Length},
+		t.TAGXTagEntryNameOffset: {b.AddString(info.Title)},
+		t.TAGXTagEntryDepthLevel: {0},
+		t.TAGXTagPeriodicalClass: {b.AddString("periodical")},
+	}
+	if len(info.Sections) > 0 {
+		periodical[t.TAGXTagPeriodicalChild1] = []int{firstSection}
+		periodical[t.TAGXTagPeriodicalChildN] = []int{firstArticle - 1}
+	}
+	if info.Masthead >= 0 {
+		periodical[t.TAGXTagPeriodicalImage] = []int{info.Masthead}
+	}
+	entries = append(entries, periodical)
+
+	// Section entries
+	articleIdx := firstArticle
+	for _, sec := range info.Sections {
+		section := map[t.TAGXTag][]int{
+			t.TAGXTagEntryPosition:    {sec.Start},
+			t.TAGXTagEntryLength:      {sec.Length},
+			t.TAGXTagEntryNameOffset:  {b.AddString(sec.Title)},
+			t.TAGXTagEntryDepthLevel:  {1},
+			t.TAGXTagPeriodicalClass:  {b.AddString("section")},
+			t.TAGXTagPeriodicalParent: {0},
+		}
+		if len(sec.Articles) > 0 {
+			section[t.TAGXTagPeriodicalChild1] = []int{articleIdx}
+			section[t.TAGXTagPeriodicalChildN] = []int{articleIdx + len(sec.Articles) - 1}
+		}
+		entries = append(entries, section)
+		articleIdx += len(sec.Articles)
+	}
+
+	// Article entries
+	for i, sec := range info.Sections {
+		for _, art := range sec.Articles {
+			article := map[t.TAGXTag][]int{
+				t.TAGXTagEntryPosition:    {art.Start},
+				t.TAGXTagEntryLength:      {art.Length},
+				t.TAGXTagEntryNameOffset:  {b.AddString(art.Title)},
+				t.TAGXTagEntryDepthLevel:  {2},
+				t.TAGXTagPeriodicalClass:  {b.AddString("article")},
+				t.TAGXTagPeriodicalParent: {firstSection + i},
+			}
+			if len(art.Description) > 0 {
+				article[t.TAGXTagPeriodicalDesc] = []int{b.AddString(art.Description)}
+			}
+			if len(art.Author) > 0 {
+				article[t.TAGXTagPeriodicalAuthor] = []int{b.AddString(art.Author)}
+			}
+			entries = append(entries, article)
+		}
+	}
+
+	for i, entry := range entries {
+		b.Add(fmt.Sprintf("%03x", i), entry)
+	}
+
+	return b
+}
@@ -0,0 +1,57 @@
+package records
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/leotaku/mobi/pdb"
+	t "github.com/leotaku/mobi/types"
+)
+
+// RESCRecord describes the spine of the OPF package a book was
+// generated from.  Some readers use this information to lay out
+// fixed-layout books as two-page spreads.
+type RESCRecord struct {
+	data string
+}
+
+// SpineItem represents a single itemref in the spine of a RESCRecord.
+//
+// Properties may contain OPF itemref properties such as
+// "page-spread-left" or "page-spread-right".
+type SpineItem struct {
+	SkeletonID int
+	Properties string
+}
+
+func NewRESCRecord(direction string, items []SpineItem) RESCRecord {
+	b := new(strings.Builder)
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	b.WriteString(`<package version="2.0" xmlns="http://www.idpf.org/2007/opf" unique-identifier="uid">`)
+	b.WriteString(`<metadata></metadata>`)
+	if len(direction) > 0 {
+		fmt.Fprintf(b, `<spine page-progression-direction="%v" toc="ncx">`, direction)
+	} else {
+		b.WriteString(`<spine toc="ncx">`)
+	}
+	for _, item := range items {
+		fmt.Fprintf(b, `<itemref idref="part%04d" skelid="%v"`, item.SkeletonID, item.SkeletonID)
+		if len(item.Properties) > 0 {
+			fmt.Fprintf(b, ` properties="%v"`, item.Properties)
+		}
+		b.WriteString(`/>`)
+	}
+	b.WriteString(`</spine></package>`)
+
+	return RESCRecord{
+		data: b.String(),
+	}
+}
+
+func (r RESCRecord) Write(w io.Writer) error {
+	pre := fmt.Sprintf("size=%v&version=1&type=1", To32(len(r.data)))
+	pad := make([]byte, invMod(t.RESCHeaderLength+len(pre)+len(r.data), 4))
+
+	return writeSequential(w, pdb.Endian, t.NewRESCHeader(), []byte(pre), []byte(r.data), pad)
+}
@@ -0,0 +1,47 @@
+package records
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/leotaku/mobi/pdb"
+	t "github.com/leotaku/mobi/types"
+)
+
+// SRCSRecord embeds the source archive a book was generated from.
+type SRCSRecord struct {
+	data []byte
+}
+
+func NewSRCSRecord(data []byte) SRCSRecord {
+	return SRCSRecord{
+		data: data,
+	}
+}
+
+func (r SRCSRecord) Write(w io.Writer) error {
+	h := t.NewSRCSHeader(uint32(len(r.data)))
+	return writeSequential(w, pdb.Endian, h, r.data)
+}
+
+// ReadSRCSRecord returns the source archive embedded in the SRCS
+// record data.
+func ReadSRCSRecord(data []byte) ([]byte, error) {
+	h := t.SRCSHeader{}
+	err := binary.Read(bytes.NewReader(data), pdb.Endian, &h)
+	if err != nil {
+		return nil, err
+	}
+	if h.SRCS != t.NewSRCSHeader(0).SRCS || h.HeaderLength < t.SRCSHeaderLength {
+		return nil, errors.New("records: not a SRCS record")
+	}
+
+	end := uint64(h.HeaderLength) + uint64(h.DataLength)
+	if end > uint64(len(data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return data[h.HeaderLength:end], nil
+}
@@ -36,6 +36,20 @@ func encodeVwi(x int) []byte {
 	return relevant
 }
 
+// decodeVwi decodes the forward variable-width integer at the start of
+// data and returns it together with the number of bytes consumed.
+func decodeVwi(data []byte) (int, int) {
+	value := 0
+	for i, c := range data {
+		value = value<<7 | int(c&0x7F)
+		if c&0x80 != 0 {
+			return value, i + 1
+		}
+	}
+
+	return value, len(data)
+}
+
 func encodeTrailingBytes(data []byte) []byte {
 	return append(data, encodeVwi(len(data))...)
 }
@@ -59,38 +73,6 @@ func maxMod(a, n int) int {
 	}
 }
 
-var bitmaskToShiftMap = map[uint8]uint8{1: 0, 2: 1, 3: 0, 4: 2, 8: 3, 12: 2, 16: 4, 32: 5, 48: 4, 64: 6, 128: 7, 192: 6}
-
-func calculateControlByte(tagx t.TAGXTagTable) byte {
-	cbs := make([]byte, 0)
-	ans := uint8(0)
-	for _, tag := range tagx {
-		_, tagnum, bm, cb := deconstructTag(tag)
-		if cb == 1 {
-			cbs = append(cbs, ans)
-			ans = 0
-			continue
-		}
-		nvals := mapTagToNvals(tag)
-		nentries := nvals / tagnum
-		shifts := bitmaskToShiftMap[bm]
-		ans |= bm & (nentries << shifts)
-	}
-
-	return cbs[0]
-}
-
-func mapTagToNvals(tag t.TAGXTag) byte {
-	switch tag {
-	case t.TAGXTagSkeletonGeometry:
-		return 4
-	case t.TAGXTagChunkGeometry, t.TAGXTagSkeletonChunkCount:
-		return 2
-	default:
-		return 1
-	}
-}
-
 func deconstructTag(tag t.TAGXTag) (byte, byte, byte, byte) {
 	bs := make([]byte, 4)
 	pdb.Endian.PutUint32(bs, uint32(tag))
@@ -0,0 +1,152 @@
+package mobi
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"image"
+	"io"
+	"time"
+
+	"github.com/leotaku/mobi/pdb"
+)
+
+// Reproducible returns a copy of the book in which all fields that
+// usually vary between builds are derived from the given seed or, if
+// the seed is empty, from the content of the book.
+//
+// The creation date is set to the publishing date of the book, or the
+// Unix epoch if there is none, and the unique identifier is derived
+// from the seed.  As the fake ASIN identification string and all other
+// identifiers of the generated book are in turn derived from these
+// fields, converting the resulting book always yields byte-identical
+// output.
+func (m Book) Reproducible(seed string) Book {
+	h := sha256.New()
+	if len(seed) > 0 {
+		writeHashed(h, seed)
+	} else {
+		m.hashContent(h)
+	}
+
+	return m.withSum(h.Sum(nil))
+}
+
+// Reproducible is like Book.Reproducible, but also takes the sections,
+// articles and masthead of the periodical into account.
+func (p Periodical) Reproducible(seed string) Periodical {
+	h := sha256.New()
+	if len(seed) > 0 {
+		writeHashed(h, seed)
+	} else {
+		p.hashContent(h)
+	}
+	p.Book = p.Book.withSum(h.Sum(nil))
+
+	return p
+}
+
+// withSum derives all fields that usually vary between builds from the
+// given hash sum.
+func (m Book) withSum(sum []byte) Book {
+	m.UniqueID = binary.BigEndian.Uint32(sum)
+	if m.PublishedDate != (time.Time{}) {
+		m.CreatedDate = m.PublishedDate
+	} else {
+		m.CreatedDate = time.Unix(0, 0).UTC()
+	}
+
+	return m
+}
+
+func (m Book) hashContent(h hash.Hash) {
+	writeHashed(h, m.Title, m.Publisher, m.Subject, m.DocType, m.Language.String())
+	writeHashed(h, m.InputLanguage.String(), m.OutputLanguage.String())
+	writeHashed(h, m.Authors...)
+	writeHashed(h, m.Contributors...)
+	writeHashed(h, m.PublishedDate.UTC().Format(time.RFC3339Nano), m.ASIN)
+	_ = binary.Write(h, pdb.Endian, []bool{
+		m.FixedLayout, m.RightToLeft, m.Vertical, m.EmbedSpine, m.DuplicateASIN, m.OmitASIN, m.sample,
+	})
+	if m.StartReading != nil {
+		writeHashed(h, fmt.Sprint(m.StartReading.Chapter), m.StartReading.Anchor)
+	} else {
+		writeHashed(h, "")
+	}
+	writeHashed(h, fmt.Sprintf("%+v", m.ImageProfile))
+	if m.CoverProfile != nil {
+		writeHashed(h, fmt.Sprintf("%+v", *m.CoverProfile))
+	} else {
+		writeHashed(h, "")
+	}
+	for _, flow := range m.flows() {
+		writeHashed(h, flow.MIME, flow.Content)
+	}
+	hashChapters(h, m.Chapters)
+	for _, img := range m.Images {
+		hashImage(h, img)
+	}
+	hashImage(h, m.CoverImage)
+	hashImage(h, m.ThumbImage)
+	_, _ = h.Write(m.SourceArchive)
+}
+
+func (p Periodical) hashContent(h hash.Hash) {
+	p.Book.hashContent(h)
+	_ = binary.Write(h, pdb.Endian, p.Magazine)
+	hashImage(h, p.Masthead)
+	_ = binary.Write(h, pdb.Endian, uint64(len(p.Sections)))
+	for _, sec := range p.Sections {
+		writeHashed(h, sec.Title)
+		_ = binary.Write(h, pdb.Endian, uint64(len(sec.Articles)))
+		for _, art := range sec.Articles {
+			writeHashed(h, art.Title, art.Description, art.Author)
+			_ = binary.Write(h, pdb.Endian, uint64(len(art.Chunks)))
+			for _, chunk := range art.Chunks {
+				writeHashed(h, chunk.Body)
+			}
+		}
+	}
+}
+
+func hashChapters(h hash.Hash, chapters []Chapter) {
+	_ = binary.Write(h, pdb.Endian, uint64(len(chapters)))
+	for _, chap := range chapters {
+		writeHashed(h, chap.Title, fmt.Sprint(chap.PageSpread))
+		for _, chunk := range chap.Chunks {
+			writeHashed(h, chunk.Body)
+		}
+		hashChapters(h, chap.SubChapters)
+	}
+}
+
+func writeHashed(w io.Writer, ss ...string) {
+	for _, s := range ss {
+		_ = binary.Write(w, pdb.Endian, uint64(len(s)))
+		_, _ = io.WriteString(w, s)
+	}
+}
+
+func hashImage(w io.Writer, img image.Image) {
+	if img == nil {
+		_ = binary.Write(w, pdb.Endian, uint64(0))
+		return
+	}
+
+	b := img.Bounds()
+	_ = binary.Write(w, pdb.Endian, [4]int64{
+		int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y),
+	})
+	row := make([]byte, 0, b.Dx()*8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			for _, c := range []uint32{r, g, b, a} {
+				row = append(row, byte(c>>8), byte(c))
+			}
+		}
+		_, _ = w.Write(row)
+	}
+}
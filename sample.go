@@ -0,0 +1,195 @@
+package mobi
+
+import (
+	"errors"
+	"image"
+	"regexp"
+	"strconv"
+)
+
+// ErrInvalidSample is returned when sample options do not select any
+// part of a book.
+var ErrInvalidSample = errors.New("mobi: invalid sample options")
+
+// SampleOptions describes which part of a Book is included in a
+// sample.
+//
+// If Chapters is positive, the sample contains the given number of
+// top-level chapters, including their sub-chapters.  Otherwise, it
+// contains the chunks that make up the first Percent percent of the
+// text of the book, where chunks are never split.  If BuyChapter is
+// set, it is appended to the sample, usually in order to advertise
+// the full book.
+type SampleOptions struct {
+	Chapters   int
+	Percent    int
+	BuyChapter *Chapter
+}
+
+// Sample returns a copy of the book that only contains the part
+// described by opts and is marked as a sample.
+//
+// Images that are no longer referenced by any chunk or flow are
+// removed and the "kindle:embed" URIs of the remaining images are
+// updated accordingly.  References in custom skeleton sections are
+// not taken into account.  The start location of the book is kept if
+// it still refers to content of the sample.
+func (m Book) Sample(opts SampleOptions) (Book, error) {
+	switch {
+	case opts.Chapters > 0:
+		m.Chapters = m.Chapters[:min(opts.Chapters, len(m.Chapters))]
+	case opts.Percent > 0 && opts.Percent <= 100:
+		total := 0
+		for _, chap := range flattenChapters(m.Chapters) {
+			for _, chunk := range chap.Chunks {
+				total += len(chunk.Body)
+			}
+		}
+		remaining := total * opts.Percent / 100
+		m.Chapters = truncateChapters(m.Chapters, &remaining)
+	default:
+		return m, ErrInvalidSample
+	}
+
+	if m.StartReading != nil && !m.hasLocation(*m.StartReading) {
+		m.StartReading = nil
+	}
+	if opts.BuyChapter != nil {
+		m.Chapters = append(m.Chapters[:len(m.Chapters):len(m.Chapters)], *opts.BuyChapter)
+	}
+	m.sample = true
+
+	return m.removeUnusedImages(), nil
+}
+
+// truncateChapters returns the chapters that contain the first
+// remaining bytes of chunk bodies.
+func truncateChapters(chapters []Chapter, remaining *int) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		if *remaining <= 0 {
+			break
+		}
+		chunks := make([]Chunk, 0)
+		for _, chunk := range chap.Chunks {
+			if *remaining <= 0 {
+				break
+			}
+			chunks = append(chunks, chunk)
+			*remaining -= len(chunk.Body)
+		}
+		chap.Chunks = chunks
+		chap.SubChapters = truncateChapters(chap.SubChapters, remaining)
+		result = append(result, chap)
+	}
+
+	return result
+}
+
+// hasLocation reports whether the location refers to content of the
+// book.
+func (m Book) hasLocation(loc StartLocation) bool {
+	chapters := flattenChapters(m.Chapters)
+	if loc.Chapter < 0 || loc.Chapter >= len(chapters) {
+		return false
+	}
+	if len(loc.Anchor) == 0 {
+		return true
+	}
+	for _, chunk := range chapters[loc.Chapter].Chunks {
+		if findAnchor(chunk.Body, loc.Anchor) >= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+var embedRegexp = regexp.MustCompile(`kindle:embed:([0-9A-Va-v]{4})`)
+
+// removeUnusedImages returns a copy of the book without images that
+// are not referenced by any chunk or flow.
+func (m Book) removeUnusedImages() Book {
+	used := make(map[int]bool)
+	m.rewriteReferences(func(uri string) string {
+		if i, ok := parseEmbed(uri); ok {
+			used[i] = true
+		}
+		return uri
+	})
+
+	// Cover and thumbnail images are stored after all other images
+	ids := make(map[int]int)
+	images := make([]image.Image, 0)
+	for i, img := range m.Images {
+		if used[i] {
+			ids[i] = len(images)
+			images = append(images, img)
+		}
+	}
+	for i := range used {
+		if i >= len(m.Images) {
+			ids[i] = i - len(m.Images) + len(images)
+		}
+	}
+	m.Images = images
+
+	return m.rewriteReferences(func(uri string) string {
+		if i, ok := parseEmbed(uri); ok {
+			return m.ImageURI(ids[i])
+		}
+		return uri
+	})
+}
+
+// rewriteReferences returns a copy of the book in which all
+// "kindle:embed" URIs in chunks and flows have been replaced using f.
+func (m Book) rewriteReferences(f func(uri string) string) Book {
+	m.Chapters = rewriteChapters(m.Chapters, f)
+	cssFlows := make([]string, 0)
+	for _, css := range m.CSSFlows {
+		cssFlows = append(cssFlows, embedRegexp.ReplaceAllStringFunc(css, f))
+	}
+	m.CSSFlows = cssFlows
+	flows := make([]Flow, 0)
+	for _, flow := range m.Flows {
+		flow.Content = embedRegexp.ReplaceAllStringFunc(flow.Content, f)
+		flows = append(flows, flow)
+	}
+	m.Flows = flows
+
+	return m
+}
+
+func rewriteChapters(chapters []Chapter, f func(uri string) string) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		chunks := make([]Chunk, 0)
+		for _, chunk := range chap.Chunks {
+			chunk.Body = embedRegexp.ReplaceAllStringFunc(chunk.Body, f)
+			chunks = append(chunks, chunk)
+		}
+		chap.Chunks = chunks
+		if len(chap.SubChapters) > 0 {
+			chap.SubChapters = rewriteChapters(chap.SubChapters, f)
+		}
+		result = append(result, chap)
+	}
+
+	return result
+}
+
+// parseEmbed returns the image index referenced by a "kindle:embed"
+// URI.
+func parseEmbed(uri string) (int, bool) {
+	m := embedRegexp.FindStringSubmatch(uri)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(m[1], 32, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+
+	return int(id) - 1, true
+}
@@ -0,0 +1,45 @@
+package mobi
+
+import (
+	"errors"
+
+	"github.com/leotaku/mobi/pdb"
+	r "github.com/leotaku/mobi/records"
+)
+
+// ErrNoSourceArchive is returned when a book does not contain an
+// embedded source archive.
+var ErrNoSourceArchive = errors.New("mobi: no source archive")
+
+// ReadSourceArchive returns the source archive embedded in the SRCS
+// record of a MOBI book, as set using the SourceArchive field of the
+// Book it was generated from.
+//
+// Books generated by kindlegen usually contain a ZIP archive of all
+// source files used during conversion.
+func ReadSourceArchive(db pdb.Database) ([]byte, error) {
+	if len(db.Records) == 0 {
+		return nil, ErrNoSourceArchive
+	}
+	data, err := recordBytes(db.Records[0])
+	if err != nil {
+		return nil, err
+	}
+	null, err := r.ReadNullRecord(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown5 holds the SRCS record number and the first compilation
+	// section count holds the number of SRCS records
+	i := int(null.MOBIHeader.Unknown5)
+	if null.MOBIHeader.FirstCompilationSectionCount == 0 || i >= len(db.Records) {
+		return nil, ErrNoSourceArchive
+	}
+	data, err = recordBytes(db.Records[i])
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ReadSRCSRecord(data)
+}
@@ -0,0 +1,78 @@
+package mobi
+
+import (
+	"errors"
+	"strings"
+
+	r "github.com/leotaku/mobi/records"
+)
+
+// ErrInvalidStartLocation is returned when the start location of a
+// book does not refer to any content of the book.
+var ErrInvalidStartLocation = errors.New("mobi: invalid start location")
+
+// StartLocation designates the location at which Kindle readers open
+// a book that is read for the first time.
+//
+// Chapter is the index of a chapter in depth-first order, where
+// sub-chapters directly follow their parent.  If Anchor is empty, the
+// location is the start of the first chunk of the chapter.  Otherwise,
+// it is the element of the chapter with the given id attribute.
+type StartLocation struct {
+	Chapter int
+	Anchor  string
+}
+
+// startPosition returns the position of the start location in the
+// text, together with the chunk that contains it and the offset
+// relative to that chunk.
+func (m Book) startPosition(text string, skels []r.SkeletonInfo, chunks []r.ChunkInfo) (int, int, int, error) {
+	loc := *m.StartReading
+	chapters := flattenChapters(m.Chapters)
+	if loc.Chapter < 0 || loc.Chapter >= len(chapters) {
+		return 0, 0, 0, ErrInvalidStartLocation
+	}
+
+	// Chunks are numbered in the order of chapters
+	first := 0
+	for _, chap := range chapters[:loc.Chapter] {
+		first += len(chap.Chunks)
+	}
+	last := first + len(chapters[loc.Chapter].Chunks)
+	if len(loc.Anchor) == 0 && first < len(chunks) {
+		return chunkPosition(skels, chunks[first]), first, 0, nil
+	}
+
+	for id := first; id < last && id < len(chunks); id++ {
+		pos := chunkPosition(skels, chunks[id])
+		offset := findAnchor(text[pos:pos+chunks[id].Length], loc.Anchor)
+		if offset >= 0 {
+			return pos + offset, id, offset, nil
+		}
+	}
+
+	return 0, 0, 0, ErrInvalidStartLocation
+}
+
+// findAnchor returns the offset of the start tag of the element with
+// the given id attribute in body, or -1 if there is no such element.
+func findAnchor(body, anchor string) int {
+	for _, attr := range []string{`id="` + anchor + `"`, `id='` + anchor + `'`} {
+		i := strings.Index(body, attr)
+		if i < 0 {
+			continue
+		}
+		if offset := strings.LastIndexByte(body[:i], '<'); offset >= 0 {
+			return offset
+		}
+	}
+
+	return -1
+}
+
+// chunkPosition returns the position of the chunk in the text, which
+// follows its skeleton and all previous chunks of the same file.
+func chunkPosition(skels []r.SkeletonInfo, chunk r.ChunkInfo) int {
+	skel := skels[chunk.FileNumber]
+	return skel.Start + skel.Length + chunk.Start
+}
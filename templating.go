@@ -12,8 +12,8 @@ const defaultTemplateString = `<?xml version="1.0" encoding="UTF-8"?>
   <head>
     <title>{{ .Mobi.Title }}</title>
     <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
-    {{- range $i, $_ := .Mobi.CSSFlows }}
-    <link rel="stylesheet" type="text/css" href="kindle:flow:{{ $i | inc | base32 }}?mime=text/css"/>
+    {{- range .Stylesheets }}
+    <link rel="stylesheet" type="text/css" href="{{ . }}"/>
     {{- end }}
   </head>
   <body aid="{{ .Chunk.ID | base32 }}">
@@ -31,30 +31,88 @@ var funcMap = template.FuncMap{
 
 var defaultTemplate = template.Must(template.New("default").Funcs(funcMap).Parse(defaultTemplateString))
 
-type inventory struct {
-	Mobi    Book
-	Chapter struct {
-		Title string
-		ID    int
+// DefaultSkeleton is the SkeletonFunc used for chapters of books that
+// do not override their skeleton generation.
+var DefaultSkeleton = TemplateSkeleton(*defaultTemplate)
+
+// SkeletonFunc generates the skeleton section of a KF8 HTML file from
+// the given inventory.
+//
+// Every chapter of a book is converted to one HTML file, in which all
+// chunks of the chapter are inserted into the skeleton before the end
+// of its body.  The skeleton section generally consists of a complete
+// HTML document including head and body, with the body tag expected
+// to contain an 'aid' attribute that is equal to the base32-encoded
+// Chunk.ID of the inventory.  Errors returned by a SkeletonFunc abort
+// the conversion of a Book to a PalmDB database.
+type SkeletonFunc func(inv Inventory) (string, error)
+
+// Inventory contains the information passed to a SkeletonFunc.
+//
+// Mobi is the book that is being converted, while Stylesheets contains
+// the URIs of all flows with the "text/css" MIME type.  Chapter
+// describes the chapter the skeleton is generated for and Chunk its
+// first chunk, where Chunk IDs are unique across all chapters of a
+// book.
+type Inventory struct {
+	Mobi        Book
+	Stylesheets []string
+	Chapter     InventoryChapter
+	Chunk       InventoryChunk
+}
+
+// InventoryChapter describes the Chapter that is passed to a
+// SkeletonFunc as part of the Inventory.
+type InventoryChapter struct {
+	Title string
+	ID    int
+}
+
+// InventoryChunk describes the Chunk that is passed to a SkeletonFunc
+// as part of the Inventory.
+type InventoryChunk struct {
+	ID int
+}
+
+// TemplateSkeleton returns a SkeletonFunc that executes the template
+// tpl on the Inventory.
+//
+// In addition to the standard template functions, the functions "inc"
+// and "base32" are available to templates that have been parsed using
+// this function map.
+func TemplateSkeleton(tpl template.Template) SkeletonFunc {
+	return func(inv Inventory) (string, error) {
+		return runTemplate(tpl, inv)
 	}
-	Chunk struct {
-		ID int
+}
+
+// TemplateFuncs returns the function map used by the default skeleton
+// template, for use when parsing custom templates.
+func TemplateFuncs() template.FuncMap {
+	fm := template.FuncMap{}
+	for k, v := range funcMap {
+		fm[k] = v
 	}
+
+	return fm
 }
 
-func newInventory(m Book, c Chapter, chapID int, chunkID int) inventory {
-	return inventory{
-		Mobi: m,
-		Chapter: struct {
-			Title string
-			ID    int
-		}{
+func newInventory(m Book, c Chapter, chapID int, chunkID int) Inventory {
+	stylesheets := make([]string, 0)
+	for i, flow := range m.flows() {
+		if flow.MIME == "text/css" {
+			stylesheets = append(stylesheets, flowURI(i+1, flow.MIME))
+		}
+	}
+
+	return Inventory{
+		Mobi:        m,
+		Stylesheets: stylesheets,
+		Chapter: InventoryChapter{
 			Title: c.Title,
 			ID:    chapID,
 		},
-		Chunk: struct {
-			ID int
-		}{
+		Chunk: InventoryChunk{
 			ID: chunkID,
 		},
 	}
@@ -89,3 +89,39 @@ func (r FCISRecord) Write(w io.Writer) error {
 const EOFRecordLength = 4
 
 var EOFRecord = pdb.RawRecord{0xE9, 0x8E, 0x0D, 0x0A}
+
+const SRCSHeaderLength = 16 // 0x10
+
+type SRCSHeader struct {
+	SRCS         [4]byte
+	HeaderLength uint32
+	DataLength   uint32
+	Unknown      uint32
+}
+
+func NewSRCSHeader(DataLength uint32) SRCSHeader {
+	return SRCSHeader{
+		SRCS:         [4]byte{'S', 'R', 'C', 'S'},
+		HeaderLength: SRCSHeaderLength,
+		DataLength:   DataLength,
+		Unknown:      1,
+	}
+}
+
+const RESCHeaderLength = 16 // 0x10
+
+type RESCHeader struct {
+	RESC         [4]byte
+	HeaderLength uint32
+	Unknown1     uint32
+	Unknown2     uint32
+}
+
+func NewRESCHeader() RESCHeader {
+	return RESCHeader{
+		RESC:         [4]byte{'R', 'E', 'S', 'C'},
+		HeaderLength: RESCHeaderLength,
+		Unknown1:     0,
+		Unknown2:     1,
+	}
+}
@@ -111,11 +111,44 @@ const (
 	TAGXTagChunkGeometry       TAGXTag = 0x06020800
 	TAGXTagGuideTitle          TAGXTag = 0x01010100
 	TAGXTagGuidePosFid         TAGXTag = 0x06020200
+	TAGXTagPeriodicalClass     TAGXTag = 0x05011000
+	TAGXTagPeriodicalParent    TAGXTag = 0x15012000
+	TAGXTagPeriodicalChild1    TAGXTag = 0x16014000
+	TAGXTagPeriodicalChildN    TAGXTag = 0x17018000
+	TAGXTagPeriodicalImage     TAGXTag = 0x45010100
+	TAGXTagPeriodicalDesc      TAGXTag = 0x46010200
+	TAGXTagPeriodicalAuthor    TAGXTag = 0x47010400
+	TAGXTagPeriodicalCaption   TAGXTag = 0x48010800
+	TAGXTagPeriodicalAttrib    TAGXTag = 0x49011000
 	TAGXTagEnd                 TAGXTag = 0x00000001
 )
 
 type TAGXTagTable []TAGXTag
 
+// ControlByteCount returns the number of control bytes preceding the
+// tag values of each index entry described by the table.
+func (t TAGXTagTable) ControlByteCount() int {
+	count := 0
+	for _, tag := range t {
+		if tag == TAGXTagEnd {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Contains reports whether the table contains the given tag.
+func (t TAGXTagTable) Contains(tag TAGXTag) bool {
+	for _, other := range t {
+		if other == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
 var TAGXTableNCXSingle = TAGXTagTable{
 	TAGXTagEntryPosition,
 	TAGXTagEntryLength,
@@ -124,6 +157,17 @@ var TAGXTableNCXSingle = TAGXTagTable{
 	TAGXTagEnd,
 }
 
+var TAGXTableNCX = TAGXTagTable{
+	TAGXTagEntryPosition,
+	TAGXTagEntryLength,
+	TAGXTagEntryNameOffset,
+	TAGXTagEntryDepthLevel,
+	TAGXTagEntryParent,
+	TAGXTagEntryChild1,
+	TAGXTagEntryChildN,
+	TAGXTagEnd,
+}
+
 var TAGXTableSkeleton = TAGXTagTable{
 	TAGXTagSkeletonChunkCount,
 	TAGXTagSkeletonGeometry,
@@ -138,6 +182,24 @@ var TAGXTableChunk = TAGXTagTable{
 	TAGXTagEnd,
 }
 
+var TAGXTablePeriodical = TAGXTagTable{
+	TAGXTagEntryPosition,
+	TAGXTagEntryLength,
+	TAGXTagEntryNameOffset,
+	TAGXTagEntryDepthLevel,
+	TAGXTagPeriodicalClass,
+	TAGXTagPeriodicalParent,
+	TAGXTagPeriodicalChild1,
+	TAGXTagPeriodicalChildN,
+	TAGXTagEnd,
+	TAGXTagPeriodicalImage,
+	TAGXTagPeriodicalDesc,
+	TAGXTagPeriodicalAuthor,
+	TAGXTagPeriodicalCaption,
+	TAGXTagPeriodicalAttrib,
+	TAGXTagEnd,
+}
+
 var TAGXTableGuide = TAGXTagTable{
 	TAGXTagGuideTitle,
 	TAGXTagGuidePosFid,
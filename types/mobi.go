@@ -26,6 +26,36 @@ func NewPalmDocHeader() PalmDocHeader {
 	}
 }
 
+// TEXtHeader is the header of the first record of a classic PalmDOC
+// database, which stores the current reading position in place of the
+// encryption fields of the PalmDocHeader.
+type TEXtHeader struct {
+	Compression     uint16
+	Unused1         uint16
+	TextLength      uint32
+	TextRecordCount uint16
+	RecordSize      uint16
+	CurrentPosition uint32
+}
+
+func NewTEXtHeader() TEXtHeader {
+	return TEXtHeader{
+		Compression:     2,
+		Unused1:         0,
+		TextLength:      0,
+		TextRecordCount: 0,
+		RecordSize:      0x1000,
+		CurrentPosition: 0,
+	}
+}
+
+// TEXtBookmark is a bookmark record of a classic PalmDOC database,
+// which follows the text records.
+type TEXtBookmark struct {
+	Name   [16]byte
+	Offset uint32
+}
+
 const MOBIHeaderLength = 232 // 0xE8
 
 type MOBIHeader struct {
@@ -72,8 +102,8 @@ type MOBIHeader struct {
 	FLISRecordNumber                        uint32
 	FLISRecordCount                         uint32
 	Unknown4                                uint64
-	Unknown5                                uint32
-	FirstCompilationSectionCount            uint32
+	Unknown5                                uint32 // SRCS record number
+	FirstCompilationSectionCount            uint32 // SRCS record count
 	CompilationSectionCount                 uint32
 	Unknown6                                uint32
 	ExtraRecordDataFlags                    uint32
@@ -1,46 +1,140 @@
 package mobi
 
 import (
+	"bytes"
+	"fmt"
 	"strings"
 
+	"github.com/leotaku/mobi/pdb"
 	r "github.com/leotaku/mobi/records"
 )
 
-func chaptersToText(m Book) (string, []r.ChunkInfo, []r.ChapterInfo, error) {
-	text := new(strings.Builder)
-	chunks := make([]r.ChunkInfo, 0)
-	chaps := make([]r.ChapterInfo, 0)
-	if m.tpl == nil {
-		m.tpl = defaultTemplate
+func chaptersToText(m Book) (string, []r.SkeletonInfo, []r.ChunkInfo, []r.ChapterInfo, error) {
+	c := &textConverter{
+		book:   m,
+		text:   new(strings.Builder),
+		skels:  make([]r.SkeletonInfo, 0),
+		chunks: make([]r.ChunkInfo, 0),
+	}
+	chaps, err := c.convert(m.Chapters)
+	if err != nil {
+		return "", nil, nil, nil, err
 	}
 
-	chunkId := 0
-	for chapId, chap := range m.Chapters {
-		chapStart := text.Len()
-		for _, chunk := range chap.Chunks {
-			inv := newInventory(m, chap, chapId, chunkId)
-			head, err := runTemplate(*m.tpl, inv)
+	return c.text.String(), c.skels, c.chunks, chaps, nil
+}
+
+// textConverter accumulates the text of a book while chapters and
+// their sub-chapters are converted in depth-first order.
+type textConverter struct {
+	book    Book
+	text    *strings.Builder
+	skels   []r.SkeletonInfo
+	chunks  []r.ChunkInfo
+	chapID  int
+	chunkID int
+}
+
+func (c *textConverter) convert(chapters []Chapter) ([]r.ChapterInfo, error) {
+	chaps := make([]r.ChapterInfo, 0)
+	for _, chap := range chapters {
+		chapStart := c.text.Len()
+		if len(chap.Chunks) > 0 {
+			err := c.convertFile(chap)
 			if err != nil {
-				return "", nil, nil, err
+				return nil, err
 			}
-			chunks = append(chunks, r.ChunkInfo{
-				PreStart:      text.Len(),
-				PreLength:     len(head),
-				ContentStart:  text.Len() + len(head),
-				ContentLength: len(chunk.Body),
-			})
-			text.WriteString(head)
-			text.WriteString(chunk.Body)
-			chunkId++
 		}
-		chaps = append(chaps, r.ChapterInfo{
+		c.chapID++
+
+		subs, err := c.convert(chap.SubChapters)
+		if err != nil {
+			return nil, err
+		}
+		info := r.ChapterInfo{
 			Title:  chap.Title,
 			Start:  chapStart,
-			Length: text.Len() - chapStart,
+			Length: c.text.Len() - chapStart,
+		}
+		if len(subs) > 0 {
+			info.SubChapters = subs
+		}
+		chaps = append(chaps, info)
+	}
+
+	return chaps, nil
+}
+
+func (c *textConverter) convertFile(chap Chapter) error {
+	skeleton := DefaultSkeleton
+	switch {
+	case chap.skeleton != nil:
+		skeleton = chap.skeleton
+	case c.book.skeleton != nil:
+		skeleton = c.book.skeleton
+	}
+	inv := newInventory(c.book, chap, c.chapID, c.chunkID)
+	head, err := skeleton(inv)
+	if err != nil {
+		return fmt.Errorf("mobi: chapter %v: %w", c.chapID, err)
+	}
+
+	// Chunks are inserted in order before the end of the body
+	chapStart := c.text.Len()
+	insertPos := strings.LastIndex(head, "</body>")
+	if insertPos < 0 {
+		insertPos = len(head)
+	}
+	insertPos += chapStart
+	c.skels = append(c.skels, r.SkeletonInfo{
+		Start:      chapStart,
+		Length:     len(head),
+		ChunkCount: len(chap.Chunks),
+	})
+	c.text.WriteString(head)
+
+	fileStart := c.text.Len()
+	for _, chunk := range chap.Chunks {
+		start := c.text.Len() - fileStart
+		c.chunks = append(c.chunks, r.ChunkInfo{
+			InsertPos:  insertPos + start,
+			Selector:   r.To32(inv.Chunk.ID),
+			FileNumber: len(c.skels) - 1,
+			Start:      start,
+			Length:     len(chunk.Body),
 		})
+		c.text.WriteString(chunk.Body)
+		c.chunkID++
 	}
 
-	return text.String(), chunks, chaps, nil
+	return nil
+}
+
+// flattenChapters returns the given chapters and all of their
+// sub-chapters in depth-first order, which is the order in which they
+// appear in the text of a book.
+func flattenChapters(chapters []Chapter) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		result = append(result, chap)
+		result = append(result, flattenChapters(chap.SubChapters)...)
+	}
+
+	return result
+}
+
+// assembleFile reconstructs the HTML file described by the skeleton
+// by inserting the given chunks, as Kindle readers would.
+func assembleFile(text string, skel r.SkeletonInfo, chunks []r.ChunkInfo) string {
+	file := text[skel.Start : skel.Start+skel.Length]
+	chunkStart := skel.Start + skel.Length
+	for _, chunk := range chunks {
+		pos := chunk.InsertPos - skel.Start
+		body := text[chunkStart+chunk.Start : chunkStart+chunk.Start+chunk.Length]
+		file = file[:pos] + body + file[pos:]
+	}
+
+	return file
 }
 
 func textToRecords(html string, chapters []r.ChapterInfo) []r.TextRecord {
@@ -61,9 +155,41 @@ func textToRecords(html string, chapters []r.ChapterInfo) []r.TextRecord {
 	return records
 }
 
+// addIndex adds all records of the index to the database and returns
+// the number of its header record.
+func addIndex(db *pdb.Database, index *r.IndexBuilder) uint32 {
+	idx := db.Idx() + 1
+	for _, rec := range index.Records() {
+		db.AddRecord(rec)
+	}
+
+	return uint32(idx)
+}
+
+func recordBytes(rec pdb.Record) ([]byte, error) {
+	if raw, ok := rec.(pdb.RawRecord); ok {
+		return raw, nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := rec.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+package mobi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/leotaku/mobi/xhtml"
+)
+
+// ValidationError describes a problem with the markup of a Chapter.
+//
+// Chapter is the index of the affected chapter when all chapters and
+// sub-chapters are listed in depth-first order.  Chunk is the index of
+// the affected chunk inside the chapter, or -1 if the problem concerns
+// the complete HTML file generated for the chapter, including its
+// skeleton section.
+type ValidationError struct {
+	Chapter int
+	Chunk   int
+	Err     error
+}
+
+func (e ValidationError) Error() string {
+	if e.Chunk < 0 {
+		return fmt.Sprintf("mobi: chapter %v: %v", e.Chapter, e.Err)
+	}
+
+	return fmt.Sprintf("mobi: chapter %v, chunk %v: %v", e.Chapter, e.Chunk, e.Err)
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is a list of problems with the markup of a Book.
+type ValidationErrors []ValidationError
+
+func (es ValidationErrors) Error() string {
+	msgs := make([]string, 0)
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks that every chunk of the book and every HTML file
+// generated from its chapters is well-formed XHTML, which is required
+// for Kindle readers to display the book correctly.
+//
+// Returns ValidationErrors describing all problems if there are any.
+// Files are only checked if all of their chunks are well-formed.
+func (m Book) Validate() error {
+	html, skels, chunks, _, err := chaptersToText(m)
+	if err != nil {
+		return err
+	}
+
+	errs := make(ValidationErrors, 0)
+	fileID := 0
+	chunkID := 0
+	for chapID, chap := range flattenChapters(m.Chapters) {
+		if len(chap.Chunks) == 0 {
+			continue
+		}
+		valid := true
+		for i, chunk := range chap.Chunks {
+			err := xhtml.CheckFragment(chunk.Body)
+			if err != nil {
+				errs = append(errs, ValidationError{chapID, i, err})
+				valid = false
+			}
+		}
+
+		skel := skels[fileID]
+		file := assembleFile(html, skel, chunks[chunkID:chunkID+skel.ChunkCount])
+		if valid {
+			err := xhtml.Check(file)
+			if err != nil {
+				errs = append(errs, ValidationError{chapID, -1, err})
+			}
+		}
+		fileID++
+		chunkID += skel.ChunkCount
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Sanitize returns a copy of the book in which all chunks have been
+// converted to well-formed XHTML that only contains elements,
+// attributes and CSS properties supported by Kindle readers.  CSS
+// flows are sanitized as well.
+//
+// Returns ValidationErrors describing all chunks that could not be
+// sanitized.
+func (m Book) Sanitize() (Book, error) {
+	errs := make(ValidationErrors, 0)
+	chapID := 0
+	m.Chapters = sanitizeChapters(m.Chapters, &chapID, &errs)
+
+	cssFlows := make([]string, 0)
+	for _, css := range m.CSSFlows {
+		cssFlows = append(cssFlows, xhtml.SanitizeCSS(css))
+	}
+	m.CSSFlows = cssFlows
+
+	flows := make([]Flow, 0)
+	for _, flow := range m.Flows {
+		if flow.MIME == "text/css" {
+			flow.Content = xhtml.SanitizeCSS(flow.Content)
+		}
+		flows = append(flows, flow)
+	}
+	m.Flows = flows
+
+	if len(errs) > 0 {
+		return m, errs
+	}
+
+	return m, nil
+}
+
+func sanitizeChapters(chapters []Chapter, chapID *int, errs *ValidationErrors) []Chapter {
+	result := make([]Chapter, 0)
+	for _, chap := range chapters {
+		chunks := make([]Chunk, 0)
+		for i, chunk := range chap.Chunks {
+			body, err := xhtml.SanitizeFragment(chunk.Body)
+			if err != nil {
+				*errs = append(*errs, ValidationError{*chapID, i, err})
+			}
+			chunks = append(chunks, Chunk{Body: body})
+		}
+		chap.Chunks = chunks
+		*chapID++
+		if len(chap.SubChapters) > 0 {
+			chap.SubChapters = sanitizeChapters(chap.SubChapters, chapID, errs)
+		}
+		result = append(result, chap)
+	}
+
+	return result
+}
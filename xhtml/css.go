@@ -0,0 +1,131 @@
+package xhtml
+
+import "strings"
+
+// Properties removed from CSS declarations, either because they are
+// unsupported by Kindle readers or because they only make sense for
+// interactive documents.
+var unsupportedProperties = map[string]bool{
+	"animation":       true,
+	"backdrop-filter": true,
+	"clip-path":       true,
+	"cursor":          true,
+	"filter":          true,
+	"mix-blend-mode":  true,
+	"pointer-events":  true,
+	"resize":          true,
+	"transition":      true,
+	"user-select":     true,
+	"will-change":     true,
+}
+
+// SanitizeDeclarations removes unsupported properties from the list of
+// CSS declarations s, as found in the style attribute of an element.
+func SanitizeDeclarations(s string) string {
+	result := make([]string, 0)
+	start := 0
+	for i := 0; i <= len(s); {
+		if i < len(s) && s[i] != ';' {
+			i = tokenEnd(s, i)
+			continue
+		}
+		decl := strings.TrimSpace(s[start:i])
+		if len(decl) > 0 && isSupported(decl) {
+			result = append(result, decl)
+		}
+		i++
+		start = i
+	}
+
+	return strings.Join(result, "; ")
+}
+
+// SanitizeCSS removes unsupported properties from all declaration
+// blocks of the CSS stylesheet s.  Comments are removed as well.
+func SanitizeCSS(s string) string {
+	b := new(strings.Builder)
+	decl := new(strings.Builder)
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '/' && strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end + 3
+			}
+		case c == '{':
+			b.WriteString(decl.String())
+			b.WriteByte(c)
+			decl.Reset()
+			depth++
+		case depth > 0 && (c == ';' || c == '}'):
+			trimmed := strings.TrimSpace(decl.String())
+			if len(trimmed) > 0 && isSupported(trimmed) {
+				b.WriteString(decl.String())
+				if c == ';' {
+					b.WriteByte(c)
+				}
+			}
+			if c == '}' {
+				b.WriteByte(c)
+				depth--
+			}
+			decl.Reset()
+		default:
+			end := tokenEnd(s, i)
+			decl.WriteString(s[i:end])
+			i = end - 1
+		}
+	}
+	b.WriteString(decl.String())
+
+	return b.String()
+}
+
+// tokenEnd returns the end of the string or parenthesized group that
+// starts at position i of s, or i+1 for any other character, so that
+// delimiters inside of quotes and url() values are kept intact.
+func tokenEnd(s string, i int) int {
+	switch s[i] {
+	case '"', '\'':
+		for j := i + 1; j < len(s); j++ {
+			switch s[j] {
+			case '\\':
+				j++
+			case s[i]:
+				return j + 1
+			}
+		}
+		return len(s)
+	case '(':
+		for j := i + 1; j < len(s); {
+			if s[j] == ')' {
+				return j + 1
+			}
+			j = tokenEnd(s, j)
+		}
+		return len(s)
+	}
+
+	return i + 1
+}
+
+func isSupported(decl string) bool {
+	colon := strings.IndexByte(decl, ':')
+	if colon < 0 {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSpace(decl[:colon]))
+	value := strings.ToLower(strings.TrimSpace(decl[colon+1:]))
+	name = strings.TrimPrefix(name, "-webkit-")
+	name = strings.TrimPrefix(name, "-moz-")
+	for prefix := range unsupportedProperties {
+		if name == prefix || strings.HasPrefix(name, prefix+"-") {
+			return false
+		}
+	}
+
+	return !(name == "position" && strings.HasPrefix(value, "fixed"))
+}
@@ -0,0 +1,275 @@
+// Package xhtml implements checking and sanitizing KF8 HTML markup.
+//
+// KF8 HTML is parsed as XML by Kindle readers, so markup that is not
+// well-formed usually results in blank pages.  Additionally, many
+// HTML elements and CSS properties that are common on the web are not
+// supported and are best removed before conversion.
+package xhtml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// Check returns an error if the HTML document s is not well-formed.
+//
+// Only the entities predefined by XML are accepted, as Kindle readers
+// do not understand named HTML entities such as "&nbsp;".
+func Check(s string) error {
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// CheckFragment returns an error if the HTML fragment s, which may
+// consist of multiple elements and text, is not well-formed.
+func CheckFragment(s string) error {
+	return Check(wrapFragment(s))
+}
+
+// Sanitize converts the HTML document s to well-formed XHTML that only
+// contains elements, attributes and inline CSS properties supported by
+// Kindle readers.
+//
+// Markup is parsed leniently, so named HTML entities are replaced by
+// the characters they represent, unclosed elements are closed and
+// stray end tags are removed.  Returns an error only if s cannot be
+// tokenized at all.
+func Sanitize(s string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(s))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	w := newWriter()
+
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		w.token(xml.CopyToken(tok))
+	}
+	w.closeAll()
+
+	return w.buf.String(), nil
+}
+
+// SanitizeFragment is like Sanitize, but sanitizes the HTML fragment
+// s, which may consist of multiple elements and text.
+func SanitizeFragment(s string) (string, error) {
+	result, err := Sanitize(wrapFragment(s))
+	if err != nil {
+		return "", err
+	}
+	result = strings.TrimPrefix(result, fragmentStart)
+	result = strings.TrimSuffix(result, fragmentEnd)
+
+	return result, nil
+}
+
+// Fragments are wrapped in an element that is unlikely to occur.
+const (
+	fragmentStart = "<xhtml-fragment>"
+	fragmentEnd   = "</xhtml-fragment>"
+)
+
+func wrapFragment(s string) string {
+	return fragmentStart + s + fragmentEnd
+}
+
+// Elements removed including their content.
+var removedElements = map[string]bool{
+	"script":   true,
+	"noscript": true,
+	"form":     true,
+	"select":   true,
+	"textarea": true,
+	"button":   true,
+	"iframe":   true,
+	"frameset": true,
+	"object":   true,
+	"applet":   true,
+	"canvas":   true,
+	"template": true,
+}
+
+// Void elements removed on their own.
+var removedVoidElements = map[string]bool{
+	"input": true,
+	"embed": true,
+	"frame": true,
+}
+
+var voidElements = map[string]bool{
+	"area":   true,
+	"base":   true,
+	"br":     true,
+	"col":    true,
+	"embed":  true,
+	"hr":     true,
+	"img":    true,
+	"input":  true,
+	"link":   true,
+	"meta":   true,
+	"param":  true,
+	"source": true,
+	"track":  true,
+	"wbr":    true,
+}
+
+type writer struct {
+	buf     *bytes.Buffer
+	stack   []xml.Name
+	pending *xml.StartElement
+	skip    []xml.Name
+}
+
+func newWriter() *writer {
+	return &writer{
+		buf:   bytes.NewBuffer(nil),
+		stack: make([]xml.Name, 0),
+	}
+}
+
+func (w *writer) token(tok xml.Token) {
+	// Skip content of removed elements, where void elements have no
+	// end tag and unclosed elements are closed by their parent
+	if len(w.skip) > 0 {
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(tok.Name.Local)
+			if !voidElements[name] && !removedVoidElements[name] {
+				w.skip = append(w.skip, tok.Name)
+			}
+		case xml.EndElement:
+			for i := len(w.skip) - 1; i >= 0; i-- {
+				if w.skip[i] == tok.Name {
+					w.skip = w.skip[:i]
+					break
+				}
+			}
+		}
+		return
+	}
+
+	switch tok := tok.(type) {
+	case xml.StartElement:
+		w.flush(false)
+		name := strings.ToLower(tok.Name.Local)
+		switch {
+		case removedElements[name]:
+			w.skip = append(w.skip, tok.Name)
+		case removedVoidElements[name]:
+		default:
+			tok.Attr = sanitizeAttrs(tok.Attr)
+			w.pending = &tok
+			if voidElements[name] {
+				w.flush(true)
+			} else {
+				w.stack = append(w.stack, tok.Name)
+			}
+		}
+	case xml.EndElement:
+		for i := len(w.stack) - 1; i >= 0; i-- {
+			if w.stack[i] == tok.Name {
+				selfClosing := w.pending != nil && w.pending.Name == tok.Name && i == len(w.stack)-1
+				w.flush(selfClosing)
+				for len(w.stack) > i {
+					w.pop(selfClosing)
+				}
+				break
+			}
+		}
+	case xml.CharData:
+		w.flush(false)
+		_ = xml.EscapeText(w.buf, tok)
+	case xml.Comment:
+		w.flush(false)
+		w.buf.WriteString("<!--")
+		w.buf.Write(bytes.ReplaceAll(tok, []byte("--"), []byte("- -")))
+		w.buf.WriteString("-->")
+	case xml.ProcInst:
+		w.flush(false)
+		w.buf.WriteString("<?" + tok.Target + " ")
+		w.buf.Write(tok.Inst)
+		w.buf.WriteString("?>")
+	case xml.Directive:
+		w.flush(false)
+		w.buf.WriteString("<!")
+		w.buf.Write(tok)
+		w.buf.WriteString(">")
+	}
+}
+
+// flush writes the pending start element, if there is one.
+func (w *writer) flush(selfClosing bool) {
+	if w.pending == nil {
+		return
+	}
+
+	w.buf.WriteString("<" + qualifiedName(w.pending.Name))
+	for _, attr := range w.pending.Attr {
+		w.buf.WriteString(" " + qualifiedName(attr.Name) + `="`)
+		_ = xml.EscapeText(w.buf, []byte(attr.Value))
+		w.buf.WriteString(`"`)
+	}
+	if selfClosing {
+		w.buf.WriteString("/>")
+	} else {
+		w.buf.WriteString(">")
+	}
+	w.pending = nil
+}
+
+func (w *writer) pop(selfClosed bool) {
+	name := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	if !selfClosed {
+		w.buf.WriteString("</" + qualifiedName(name) + ">")
+	}
+}
+
+func (w *writer) closeAll() {
+	w.flush(false)
+	for len(w.stack) > 0 {
+		w.pop(false)
+	}
+}
+
+func qualifiedName(name xml.Name) string {
+	if len(name.Space) > 0 {
+		return name.Space + ":" + name.Local
+	}
+
+	return name.Local
+}
+
+func sanitizeAttrs(attrs []xml.Attr) []xml.Attr {
+	result := make([]xml.Attr, 0)
+	for _, attr := range attrs {
+		name := strings.ToLower(attr.Name.Local)
+		value := strings.ToLower(strings.TrimSpace(attr.Value))
+		switch {
+		case len(attr.Name.Space) == 0 && strings.HasPrefix(name, "on"):
+		case strings.HasPrefix(value, "javascript:"):
+		case len(attr.Name.Space) == 0 && name == "style":
+			attr.Value = SanitizeDeclarations(attr.Value)
+			if len(attr.Value) > 0 {
+				result = append(result, attr)
+			}
+		default:
+			result = append(result, attr)
+		}
+	}
+
+	return result
+}